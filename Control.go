@@ -0,0 +1,107 @@
+// -*- coding:utf-8; -*-
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 外部から操作するための unix ドメインソケット。
+//
+// 1 行に 1 コマンドを送り、応答は "ok" か "error: <理由>" の 1 行。
+//
+//	type <text>   text を入力する。
+//	macro <name>  name のマクロを再生する。
+//
+// 引数が " で始まる場合は Go の文字列リテラルとして解釈するので、
+// 改行等は "line1\nline2" のように指定する。
+type ControlServer struct {
+	path     string
+	listener net.Listener
+	handler  func(command string, arg string) error
+}
+
+// path にソケットを作成し、受け付けたコマンドを handler で処理する。
+//
+// handler は接続毎の goroutine から呼び出す。
+func ListenControl(
+	path string, handler func(command string, arg string) error) (*ControlServer, error) {
+	// 前回のソケットが残っている場合は削除する
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		logrus.Warnf("chmod %s: %v", path, err)
+	}
+	server := &ControlServer{path, listener, handler}
+	go server.serve()
+	logrus.Infof("control socket: %s", path)
+	return server, nil
+}
+
+func (server *ControlServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			logrus.Debugf("control socket: %v", err)
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		command, arg, err := ParseControlLine(line)
+		if err == nil {
+			err = server.handler(command, arg)
+		}
+		if err != nil {
+			logrus.Warnf("control: %s: %v", line, err)
+			fmt.Fprintf(conn, "error: %v\n", err)
+		} else {
+			fmt.Fprintf(conn, "ok\n")
+		}
+	}
+}
+
+func (server *ControlServer) Close() error {
+	err := server.listener.Close()
+	os.Remove(server.path)
+	return err
+}
+
+// コマンドの行をコマンドと引数に分ける
+func ParseControlLine(line string) (string, string, error) {
+	command := line
+	arg := ""
+	if index := strings.IndexAny(line, " \t"); index >= 0 {
+		command = line[:index]
+		arg = strings.TrimLeft(line[index:], " \t")
+	}
+	if strings.HasPrefix(arg, "\"") {
+		unquoted, err := strconv.Unquote(arg)
+		if err != nil {
+			return "", "", fmt.Errorf("illegal string -- %s", arg)
+		}
+		arg = unquoted
+	}
+	return command, arg, nil
+}
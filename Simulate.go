@@ -0,0 +1,188 @@
+// -*- coding:utf-8; -*-
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+	"github.com/ifritJP/hw-keyboard-remapper/input"
+)
+
+// シミュレーションの開始時刻。出力する時刻は、ここからの経過時間。
+var simulateStart = time.Unix(0, 0)
+
+// 1 つのキーイベントのシミュレーション結果。
+//
+// header はキーイベント、 lines はそのレポートと、次のキーイベントまでのタイマーの処理。
+type simulateBlock struct {
+	header string
+	lines  []string
+}
+
+func (block *simulateBlock) equals(other *simulateBlock) bool {
+	if block.header != other.header || len(block.lines) != len(other.lines) {
+		return false
+	}
+	for index, line := range block.lines {
+		if line != other.lines[index] {
+			return false
+		}
+	}
+	return true
+}
+
+// path のセッションのキーイベントを読み込む。 path が "-" の場合は標準入力から読み込む。
+//
+// 内容は -mode record のイベントログか、 -input stdin と同じ形式のコマンド。
+// キーイベントには、 sleep やレコードの時刻から計算したシミュレーション上の時刻を設定する。
+func readSimulateInput(path string) ([]engine.KeyEvent, error) {
+	var reader io.Reader
+	switch path {
+	case "":
+		return nil, fmt.Errorf("session isn't set. Please set -session option.")
+	case "-":
+		reader = os.Stdin
+	default:
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+	keyEvents := []engine.KeyEvent{}
+	now := simulateStart
+	err := input.ReadKeyLines(reader, func(keyEvent engine.KeyEvent, wait time.Duration) bool {
+		now = now.Add(wait)
+		keyEvent.Time = now
+		keyEvents = append(keyEvents, keyEvent)
+		return true
+	})
+	return keyEvents, err
+}
+
+// keyEvents を remapper に通し、結果をキーイベント毎にまとめて返す。
+//
+// 最後のブロックは、入力の終了後のタイマーとリリースの処理。
+func simulate(remapper *engine.Remapper, keyEvents []engine.KeyEvent) []*simulateBlock {
+	sim := engine.NewSimulator(remapper.Processor, simulateStart)
+	blocks := []*simulateBlock{}
+	// 処理中のブロック。タイマーの処理は直前のキーイベントのブロックに入れる。
+	block := &simulateBlock{header: "start"}
+	addStep := func(step engine.SimulateStep) {
+		if step.KeyEvent != nil {
+			blocks = append(blocks, block)
+			block = &simulateBlock{header: fmt.Sprintf(
+				"%s %s %s", simulateTime(step.Time),
+				step.KeyEvent.Name, keyDirection(step.KeyEvent))}
+		} else if len(step.Reports) > 0 || step.Action != engine.HotkeyAction_None {
+			block.lines = append(block.lines, fmt.Sprintf("  %s timer", simulateTime(step.Time)))
+		}
+		if step.Action != engine.HotkeyAction_None {
+			block.lines = append(block.lines, fmt.Sprintf("    hotkey %v", step.Action))
+		}
+		for _, report := range step.Reports {
+			block.lines = append(block.lines, "    "+describeReport(report))
+		}
+	}
+	for _, keyEvent := range keyEvents {
+		for _, step := range sim.Feed(keyEvent) {
+			addStep(step)
+		}
+		if sim.Exited() {
+			break
+		}
+	}
+	finish := sim.Finish()
+	blocks = append(blocks, block)
+	block = &simulateBlock{header: "end"}
+	for _, step := range finish {
+		addStep(step)
+	}
+	if !sim.Exited() {
+		// remap モードと同じく、入力の終了時に全キーをリリースする
+		block.lines = append(block.lines, "  release")
+		for _, report := range remapper.Processor.Reset() {
+			block.lines = append(block.lines, "    "+describeReport(report))
+		}
+	}
+	// 先頭の start はキーイベントより前の処理なので、空なら省く
+	if len(blocks[0].lines) == 0 {
+		blocks = blocks[1:]
+	}
+	return append(blocks, block)
+}
+
+// シミュレーション開始からの経過時間
+func simulateTime(at time.Time) string {
+	return fmt.Sprintf("+%.3f", at.Sub(simulateStart).Seconds())
+}
+
+func keyDirection(keyEvent *engine.KeyEvent) string {
+	if keyEvent.Pressed {
+		return "down"
+	}
+	return "up"
+}
+
+// レポートの種類、 16 進数、押されているキーの 1 行
+func describeReport(report hid.HIDReport) string {
+	return fmt.Sprintf("%-8v %s %s", report.Kind, report.Hex(), report.Describe())
+}
+
+func printSimulateBlocks(blocks []*simulateBlock) {
+	for _, block := range blocks {
+		fmt.Println(block.header)
+		for _, line := range block.lines {
+			fmt.Println(line)
+		}
+	}
+}
+
+// 2 つのシミュレーション結果の異なるキーイベントを出力し、異なるキーイベントの数を返す。
+//
+// 同じ入力を処理するので、キーイベント毎に比較する。
+// base だけの行を "-"、 other だけの行を "+" で出力する。
+func printSimulateDiff(base, other []*simulateBlock, baseName, otherName string) int {
+	fmt.Printf("--- %s\n+++ %s\n", baseName, otherName)
+	count := 0
+	for index := 0; index < len(base) || index < len(other); index++ {
+		var baseBlock, otherBlock *simulateBlock
+		if index < len(base) {
+			baseBlock = base[index]
+		}
+		if index < len(other) {
+			otherBlock = other[index]
+		}
+		if baseBlock != nil && otherBlock != nil && baseBlock.equals(otherBlock) {
+			continue
+		}
+		count++
+		if baseBlock != nil && otherBlock != nil && baseBlock.header == otherBlock.header {
+			fmt.Printf(" %s\n", baseBlock.header)
+		} else {
+			if baseBlock != nil {
+				fmt.Printf("-%s\n", baseBlock.header)
+			}
+			if otherBlock != nil {
+				fmt.Printf("+%s\n", otherBlock.header)
+			}
+		}
+		if baseBlock != nil {
+			for _, line := range baseBlock.lines {
+				fmt.Printf("-%s\n", line)
+			}
+		}
+		if otherBlock != nil {
+			for _, line := range otherBlock.lines {
+				fmt.Printf("+%s\n", line)
+			}
+		}
+	}
+	return count
+}
@@ -0,0 +1,629 @@
+// -*- coding:utf-8; -*-
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// config の JSON の値と、ファイル内の位置
+type jsonNode struct {
+	// 値の先頭のバイトオフセット
+	offset int
+	// 値の JSON
+	raw []byte
+	// オブジェクトのメンバー。オブジェクトでない場合は nil。
+	members []*jsonMember
+	// 配列の要素。配列でない場合は nil。
+	items []*jsonNode
+	// '{', '[' か、それ以外の値の場合は 0
+	kind byte
+}
+
+type jsonMember struct {
+	key string
+	// キーの先頭のバイトオフセット
+	offset int
+	value  *jsonNode
+}
+
+// key のメンバーの値を返す。 encoding/json と同じく大文字小文字を区別しない。
+func (node *jsonNode) get(key string) *jsonNode {
+	if node == nil {
+		return nil
+	}
+	for _, member := range node.members {
+		if strings.EqualFold(member.key, key) {
+			return member.value
+		}
+	}
+	return nil
+}
+
+// index 番目の要素を返す
+func (node *jsonNode) item(index int) *jsonNode {
+	if node == nil || index >= len(node.items) {
+		return nil
+	}
+	return node.items[index]
+}
+
+// data の JSON を、位置付きの jsonNode に変換する
+func parseJSONNode(data []byte) (*jsonNode, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	node, err := parseJSONValue(data, dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err == nil {
+		return nil, &json.SyntaxError{Offset: dec.InputOffset()}
+	}
+	return node, nil
+}
+
+func parseJSONValue(data []byte, dec *json.Decoder) (*jsonNode, error) {
+	node := &jsonNode{offset: skipJSONSeparator(data, int(dec.InputOffset()))}
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		node.kind = '{'
+		node.members = []*jsonMember{}
+		for dec.More() {
+			member := &jsonMember{offset: skipJSONSeparator(data, int(dec.InputOffset()))}
+			keyToken, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			member.key = keyToken.(string)
+			if member.value, err = parseJSONValue(data, dec); err != nil {
+				return nil, err
+			}
+			node.members = append(node.members, member)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	case json.Delim('['):
+		node.kind = '['
+		node.items = []*jsonNode{}
+		for dec.More() {
+			item, err := parseJSONValue(data, dec)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	node.raw = data[node.offset:dec.InputOffset()]
+	return node, nil
+}
+
+// offset から空白と区切り文字を読み飛ばした位置を返す
+func skipJSONSeparator(data []byte, offset int) int {
+	for offset < len(data) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// config の問題点
+type configProblem struct {
+	// 問題のある値のバイトオフセット。 -1 の場合は位置が無い。
+	offset  int
+	message string
+	// 設定としては正しいが、意図と異なる可能性があるもの
+	warning bool
+}
+
+// config を厳密に検査する
+type configChecker struct {
+	data     []byte
+	problems []configProblem
+}
+
+func (checker *configChecker) addf(offset int, format string, args ...interface{}) {
+	checker.problems = append(
+		checker.problems, configProblem{offset, fmt.Sprintf(format, args...), false})
+}
+
+func (checker *configChecker) warnf(offset int, format string, args ...interface{}) {
+	checker.problems = append(
+		checker.problems, configProblem{offset, fmt.Sprintf(format, args...), true})
+}
+
+// 警告以外の問題があるかどうか
+func (checker *configChecker) hasError() bool {
+	for _, problem := range checker.problems {
+		if !problem.warning {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	hidCodeType     = reflect.TypeOf(hid.HIDCode(0))
+	convKeyMapType  = reflect.TypeOf(map[string][]engine.ConvKeyInfo{})
+)
+
+// path の config を検査し、エラーと警告を "path:line:column: message" の形式で返す。
+//
+// 警告のメッセージは "warning: " で始まる。
+func CheckConfig(path string) ([]string, []string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	checker := &configChecker{data: data}
+	checker.check()
+	// 位置の無いものは最後にして、ファイル内の順に並べる
+	sort.SliceStable(checker.problems, func(i, j int) bool {
+		iOffset, jOffset := checker.problems[i].offset, checker.problems[j].offset
+		return jOffset < 0 && iOffset >= 0 || iOffset >= 0 && iOffset < jOffset
+	})
+
+	problems, warnings := []string{}, []string{}
+	for _, problem := range checker.problems {
+		message := problem.message
+		if problem.warning {
+			message = "warning: " + message
+		}
+		if problem.offset < 0 {
+			message = fmt.Sprintf("%s: %s", path, message)
+		} else {
+			line, column := textPosition(data, problem.offset)
+			message = fmt.Sprintf("%s:%d:%d: %s", path, line, column, message)
+		}
+		if problem.warning {
+			warnings = append(warnings, message)
+		} else {
+			problems = append(problems, message)
+		}
+	}
+	return problems, warnings, nil
+}
+
+// data の offset の行と桁を返す。どちらも 1 から数える。
+func textPosition(data []byte, offset int) (int, int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	head := data[:offset]
+	lineTop := bytes.LastIndexByte(head, '\n') + 1
+	return bytes.Count(head, []byte("\n")) + 1, utf8.RuneCount(head[lineTop:]) + 1
+}
+
+func (checker *configChecker) check() {
+	data := checker.data
+	root, err := parseJSONNode(data)
+	if err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			checker.addf(int(syntaxErr.Offset), "%v", err)
+		} else {
+			checker.addf(len(data), "%v", err)
+		}
+		return
+	}
+	checker.checkValue(root, reflect.TypeOf(Setting{}))
+	if len(checker.problems) > 0 {
+		// 型が合わない場合は、以降の検査ができない
+		return
+	}
+
+	var setting Setting
+	if err := json.Unmarshal(data, &setting); err != nil {
+		checker.addf(-1, "%v", err)
+		return
+	}
+	checker.checkSwitchKeys(setting.SwitchKeys, root.get("SwitchKeys"))
+	checker.checkConvKeyMap(setting.ConvKeyMap, root.get("ConvKeyMap"))
+	for index, layer := range setting.Layers {
+		checker.checkConvKeyMap(
+			layer.ConvKeyMap, root.get("Layers").item(index).get("ConvKeyMap"))
+	}
+	checker.checkReferences(&setting, root)
+	if !checker.hasError() {
+		// 上記で検査していないものは、実際に構築して確認する
+		if _, err := NewRemapper(&setting, "", nil); err != nil {
+			checker.addf(-1, "%v", err)
+		}
+	}
+}
+
+// 最初の nil でない node の位置を返す。全て nil の場合は -1。
+func nodeOffset(nodes ...*jsonNode) int {
+	for _, node := range nodes {
+		if node != nil {
+			return node.offset
+		}
+	}
+	return -1
+}
+
+// NewRemapper が検査する値と、レイヤー名やマクロ名の参照を、位置付きで検査する
+func (checker *configChecker) checkReferences(setting *Setting, root *jsonNode) {
+	if _, err := hid.ParseReportMode(setting.ReportMode); err != nil {
+		checker.addf(nodeOffset(root.get("ReportMode"), root), "%v", err)
+	}
+
+	layerNames := map[string]bool{}
+	for _, layer := range setting.Layers {
+		layerNames[layer.Name] = true
+	}
+	checkLayer := func(name string, offset int) {
+		if name != "" && !layerNames[name] {
+			checker.addf(offset, "unknown layer -- %s", name)
+		}
+	}
+	for index, layerKey := range setting.LayerKeys {
+		if layerKey.On != nil && !*layerKey.On {
+			continue
+		}
+		item := root.get("LayerKeys").item(index)
+		mode, err := engine.ParseLayerMode(layerKey.Mode)
+		if err != nil {
+			checker.addf(nodeOffset(item.get("Mode"), item), "%v", err)
+		} else if layerKey.Layer == "" && mode != engine.LayerMode_Lock {
+			checker.addf(nodeOffset(item), "unknown layer -- %s", layerKey.Layer)
+		} else {
+			checkLayer(layerKey.Layer, nodeOffset(item.get("Layer"), item))
+		}
+	}
+	for index, settingTapHold := range setting.TapHolds {
+		if settingTapHold.On != nil && !*settingTapHold.On {
+			continue
+		}
+		item := root.get("TapHolds").item(index)
+		if _, err := settingTapHold.toTapHold(); err != nil {
+			checker.addf(nodeOffset(item), "%v", err)
+			continue
+		}
+		checkLayer(settingTapHold.HoldLayer, nodeOffset(item.get("HoldLayer"), item))
+	}
+	for index, settingCombo := range setting.Combos {
+		if settingCombo.On != nil && !*settingCombo.On {
+			continue
+		}
+		item := root.get("Combos").item(index)
+		if _, err := settingCombo.toCombo(); err != nil {
+			checker.addf(nodeOffset(item), "%v", err)
+			continue
+		}
+		checkLayer(settingCombo.Layer, nodeOffset(item.get("Layer"), item))
+	}
+	for index, settingHotkey := range setting.Hotkeys {
+		if settingHotkey.On != nil && !*settingHotkey.On {
+			continue
+		}
+		item := root.get("Hotkeys").item(index)
+		if _, err := settingHotkey.toHotkey(); err != nil {
+			checker.addf(nodeOffset(item), "%v", err)
+		}
+	}
+
+	textLayout, err := engine.ParseTextLayout(setting.TextLayout)
+	if err != nil {
+		checker.addf(nodeOffset(root.get("TextLayout"), root), "%v", err)
+	}
+	if _, err := engine.ParseTextLayout(setting.PhysicalLayout); err != nil {
+		checker.addf(nodeOffset(root.get("PhysicalLayout"), root), "%v", err)
+	}
+	macroNames := map[string]bool{}
+	for index, settingMacro := range setting.Macros {
+		macroNames[settingMacro.Name] = true
+		if textLayout == nil {
+			continue
+		}
+		if _, err := settingMacro.toMacro(textLayout); err != nil {
+			checker.addf(nodeOffset(root.get("Macros").item(index)), "%v", err)
+		}
+	}
+	checkMacros := func(convKeyMap map[string][]engine.ConvKeyInfo, node *jsonNode) {
+		if node == nil {
+			return
+		}
+		for _, member := range node.members {
+			for index, convKey := range convKeyMap[member.key] {
+				if convKey.Macro != "" && !macroNames[convKey.Macro] {
+					item := member.value.item(index)
+					checker.addf(nodeOffset(item.get("macro"), item),
+						"unknown macro -- %s", convKey.Macro)
+				}
+			}
+		}
+	}
+	checkMacros(setting.ConvKeyMap, root.get("ConvKeyMap"))
+	for index, layer := range setting.Layers {
+		checkMacros(layer.ConvKeyMap, root.get("Layers").item(index).get("ConvKeyMap"))
+	}
+}
+
+// node が typ の値として正しいかを検査する
+func (checker *configChecker) checkValue(node *jsonNode, typ reflect.Type) {
+	if bytes.Equal(node.raw, []byte("null")) {
+		return
+	}
+	if reflect.PtrTo(typ).Implements(unmarshalerType) {
+		// 独自の形式の値は、実際に変換して確認する
+		value := reflect.New(typ)
+		if err := json.Unmarshal(node.raw, value.Interface()); err != nil {
+			checker.addf(node.offset, "%v", err)
+			return
+		}
+		if typ == hidCodeType {
+			checker.checkHIDCode(node.offset, uint8(value.Elem().Uint()))
+			return
+		}
+		switch {
+		case typ.Kind() == reflect.Struct && node.kind == '{':
+		case typ.Kind() == reflect.Slice && node.kind == '[':
+		case typ.Kind() == reflect.Slice:
+			// 要素 1 つを、配列にせずに指定したもの
+			checker.checkValue(node, typ.Elem())
+			return
+		default:
+			return
+		}
+	}
+
+	switch typ.Kind() {
+	case reflect.Ptr:
+		checker.checkValue(node, typ.Elem())
+	case reflect.Struct:
+		if node.kind != '{' {
+			checker.addf(node.offset, "object is required")
+			return
+		}
+		for _, member := range node.members {
+			field, has := findJSONField(typ, member.key)
+			if !has {
+				checker.addf(member.offset, "unknown key %q", member.key)
+				continue
+			}
+			checker.checkValue(member.value, field.Type)
+		}
+	case reflect.Map:
+		if node.kind != '{' {
+			checker.addf(node.offset, "object is required")
+			return
+		}
+		for _, member := range node.members {
+			if typ == convKeyMapType {
+				if code, err := hid.ParseKeyName(member.key); err != nil {
+					checker.addf(member.offset, "%v", err)
+				} else {
+					checker.checkHIDCode(member.offset, code)
+				}
+			}
+			checker.checkValue(member.value, typ.Elem())
+		}
+	case reflect.Slice:
+		if node.kind != '[' {
+			checker.addf(node.offset, "array is required")
+			return
+		}
+		for _, item := range node.items {
+			checker.checkValue(item, typ.Elem())
+		}
+	default:
+		value := reflect.New(typ)
+		if err := json.Unmarshal(node.raw, value.Interface()); err != nil {
+			checker.addf(node.offset, "%v", err)
+		}
+	}
+}
+
+// encoding/json と同じ規則で、 key に対応する typ のフィールドを探す
+func findJSONField(typ reflect.Type, key string) (reflect.StructField, bool) {
+	var folded *reflect.StructField
+	for index := 0; index < typ.NumField(); index++ {
+		field := typ.Field(index)
+		if field.PkgPath != "" {
+			// 非公開のフィールド
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if name == key {
+			return field, true
+		}
+		if folded == nil && strings.EqualFold(name, key) {
+			folded = &field
+		}
+	}
+	if folded != nil {
+		return *folded, true
+	}
+	return reflect.StructField{}, false
+}
+
+// code が Keyboard/Keypad Page の usage かどうかを検査する
+func (checker *configChecker) checkHIDCode(offset int, code uint8) {
+	if err := hidCodeError(code); err != nil {
+		checker.addf(offset, "%v", err)
+	}
+}
+
+// SwitchKeys の自身への置き換えと Src の重複を検査し、循環を警告する。
+//
+// 置き換えは 1 段だけなので、 2 つのキーの入れ替えや A → B → C → A の循環も設定としては正しい。
+// ただし、 A → B に B → A を書き足した場合等、意図しない入れ替えの可能性があるので警告する。
+func (checker *configChecker) checkSwitchKeys(switchKeys []SettingSwitchKey, node *jsonNode) {
+	src2index := map[hid.HIDCode]int{}
+	for index, switchKey := range switchKeys {
+		if switchKey.On != nil && !*switchKey.On {
+			continue
+		}
+		offset := node.item(index).offset
+		if switchKey.Src == switchKey.Dst {
+			checker.addf(offset, "SwitchKeys: %s is switched to itself",
+				hid.KeyName(uint8(switchKey.Src)))
+			continue
+		}
+		if prev, has := src2index[switchKey.Src]; has {
+			line, _ := textPosition(checker.data, node.item(prev).offset)
+			checker.addf(offset, "SwitchKeys: %s is already switched at line %d",
+				hid.KeyName(uint8(switchKey.Src)), line)
+			continue
+		}
+		src2index[switchKey.Src] = index
+	}
+
+	// ファイル内で最初の置き換えから辿り、元のキーに戻る循環を探す
+	inCycle := map[hid.HIDCode]bool{}
+	for index, switchKey := range switchKeys {
+		if srcIndex, has := src2index[switchKey.Src]; !has || srcIndex != index ||
+			inCycle[switchKey.Src] {
+			continue
+		}
+		cycle := []int{index}
+		code := switchKey.Dst
+		for code != switchKey.Src && len(cycle) <= len(src2index) {
+			next, has := src2index[code]
+			if !has {
+				break
+			}
+			cycle = append(cycle, next)
+			code = switchKeys[next].Dst
+		}
+		if code != switchKey.Src {
+			continue
+		}
+		names := []string{hid.KeyName(uint8(switchKey.Src))}
+		lines := []string{}
+		for _, cycleIndex := range cycle {
+			inCycle[switchKeys[cycleIndex].Src] = true
+			names = append(names, hid.KeyName(uint8(switchKeys[cycleIndex].Dst)))
+			if cycleIndex != index {
+				line, _ := textPosition(checker.data, node.item(cycleIndex).offset)
+				lines = append(lines, fmt.Sprint(line))
+			}
+		}
+		lineLabel := "line"
+		if len(lines) > 1 {
+			lineLabel = "lines"
+		}
+		checker.warnf(node.item(index).offset,
+			"SwitchKeys: %s is a cycle with %s %s. these keys are exchanged",
+			strings.Join(names, " -> "), lineLabel, strings.Join(lines, ", "))
+	}
+}
+
+// ConvKeyMap の置き換えの 1 つ
+type convKeyRule struct {
+	// ConvKeyMap のキー
+	key string
+	// key の置き換えのリストの位置
+	index   int
+	convKey *engine.ConvKeyInfo
+	offset  int
+}
+
+func (rule *convKeyRule) String() string {
+	return fmt.Sprintf("%s rule %d", rule.key, rule.index)
+}
+
+// ConvKeyMap の同じ HID キーコードの別の表記と、
+// 前の置き換えが常に一致するために使われない置き換えを検査する。
+//
+// "CapsLock" と "57" の様に同じ HID キーコードのキーは、まとめて検査する。
+func (checker *configChecker) checkConvKeyMap(
+	convKeyMap map[string][]engine.ConvKeyInfo, node *jsonNode) {
+	if node == nil {
+		return
+	}
+	// HID キーコード → 置き換え。ファイル内の順に並べる。
+	code2rules := map[uint8][]*convKeyRule{}
+	code2member := map[uint8]*jsonMember{}
+	for _, member := range node.members {
+		code, err := hid.ParseKeyName(member.key)
+		if err != nil {
+			// checkValue で報告済み
+			continue
+		}
+		if prev, has := code2member[code]; has {
+			line, _ := textPosition(checker.data, prev.offset)
+			checker.addf(member.offset, "ConvKeyMap %s: same key %s as %q at line %d",
+				member.key, hid.KeyName(code), prev.key, line)
+		} else {
+			code2member[code] = member
+		}
+		convKeyList := convKeyMap[member.key]
+		for index := range convKeyList {
+			code2rules[code] = append(code2rules[code], &convKeyRule{
+				member.key, index, &convKeyList[index], member.value.item(index).offset})
+		}
+	}
+	for _, member := range node.members {
+		code, err := hid.ParseKeyName(member.key)
+		if err != nil || code2member[code] != member {
+			continue
+		}
+		checker.checkConvKeyRules(code2rules[code])
+	}
+}
+
+// 同じキーの置き換え rules で、前の置き換えが常に一致するために使われないものを検査する
+func (checker *configChecker) checkConvKeyRules(rules []*convKeyRule) {
+	for index, rule := range rules {
+		convKey := rule.convKey
+		if convKey.On != nil && !*convKey.On {
+			continue
+		}
+		if !convKey.Satisfiable() {
+			checker.addf(rule.offset, "ConvKeyMap %s: rule %d never matches. "+
+				"modResult/lockResult has bits out of modMask/lockMask",
+				rule.key, rule.index)
+			continue
+		}
+		for _, prevRule := range rules[:index] {
+			prevKey := prevRule.convKey
+			if (prevKey.On != nil && !*prevKey.On) ||
+				!prevKey.Satisfiable() || !prevKey.Covers(convKey) {
+				continue
+			}
+			// 同じ表記のキーの置き換えは、番号だけで示す
+			prevName := fmt.Sprintf("rule %d", prevRule.index)
+			if prevRule.key != rule.key {
+				prevName = prevRule.String()
+			}
+			if prevKey.SameCondition(convKey) {
+				checker.addf(rule.offset,
+					"ConvKeyMap %s: rule %d conflicts with %s of the same condition",
+					rule.key, rule.index, prevName)
+			} else {
+				checker.addf(rule.offset,
+					"ConvKeyMap %s: rule %d is unreachable. %s always matches first",
+					rule.key, rule.index, prevName)
+			}
+			break
+		}
+	}
+}
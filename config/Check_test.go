@@ -0,0 +1,96 @@
+// -*- coding:utf-8; -*-
+
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// txt の config を検査し、ファイル名を除いたエラーと警告を返す
+func checkConfigText(t *testing.T, txt string) ([]string, []string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(txt), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, warnings, err := CheckConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trim := func(list []string) []string {
+		trimmed := []string{}
+		for _, item := range list {
+			trimmed = append(trimmed, strings.TrimPrefix(item, path+":"))
+		}
+		return trimmed
+	}
+	return trim(problems), trim(warnings)
+}
+
+func TestCheckSwitchKeys(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   string
+		problems []string
+		warnings []string
+	}{
+		{
+			"chain", `{"SwitchKeys": [
+  {"Src": "a", "Dst": "b"},
+  {"Src": "b", "Dst": "c"}]}`,
+			[]string{}, []string{},
+		},
+		{
+			"swap", `{"SwitchKeys": [
+  {"Src": "CapsLock", "Dst": "LeftCtrl"},
+  {"Src": "LeftCtrl", "Dst": "CapsLock"}]}`,
+			[]string{},
+			[]string{"2:3: warning: SwitchKeys: caps -> ctrl -> caps is a cycle with line 3. " +
+				"these keys are exchanged"},
+		},
+		{
+			// 循環の前のキーは含めない
+			"cycle", `{"SwitchKeys": [
+  {"Src": "x", "Dst": "a"},
+  {"Src": "a", "Dst": "b"},
+  {"Src": "b", "Dst": "c"},
+  {"Src": "c", "Dst": "a"}]}`,
+			[]string{},
+			[]string{"3:3: warning: SwitchKeys: a -> b -> c -> a is a cycle with lines 4, 5. " +
+				"these keys are exchanged"},
+		},
+		{
+			// 無効な置き換えは循環にしない
+			"disabled", `{"SwitchKeys": [
+  {"Src": "a", "Dst": "b"},
+  {"On": false, "Src": "b", "Dst": "a"}]}`,
+			[]string{}, []string{},
+		},
+		{
+			"itself and duplicated", `{"SwitchKeys": [
+  {"Src": "a", "Dst": "a"},
+  {"Src": "b", "Dst": "c"},
+  {"Src": "b", "Dst": "d"}]}`,
+			[]string{
+				"2:3: SwitchKeys: a is switched to itself",
+				"4:3: SwitchKeys: b is already switched at line 3",
+			},
+			[]string{},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			problems, warnings := checkConfigText(t, testCase.config)
+			if !reflect.DeepEqual(problems, testCase.problems) {
+				t.Errorf("problems %q, expected %q", problems, testCase.problems)
+			}
+			if !reflect.DeepEqual(warnings, testCase.warnings) {
+				t.Errorf("warnings %q, expected %q", warnings, testCase.warnings)
+			}
+		})
+	}
+}
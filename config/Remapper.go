@@ -0,0 +1,235 @@
+// -*- coding:utf-8; -*-
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// 終了するデフォルトのキーシーケンス
+const default_exit_sequence = "qweqweqweqwe"
+
+// setting からキーの処理系を構築する。
+//
+// layoutName が空でない場合は、 setting.TextLayout の代わりに使用する。
+// エンジンのログは log に出力する。
+func NewRemapper(
+	setting *Setting, layoutName string, log engine.Logger) (*engine.Remapper, error) {
+	convCode := engine.NewCode2HidCode()
+	hidKeyboard := engine.NewHIDKeyboard()
+	processor := engine.NewKeyProcessor(convCode, hidKeyboard)
+	if log == nil {
+		log = engine.NopLogger{}
+	}
+	processor.SetLogger(log)
+
+	// engine は usage 名の無い HID キーコードを扱えないので、ここで弾く
+	if err := checkHIDCodes(reflect.ValueOf(setting).Elem(), ""); err != nil {
+		return nil, err
+	}
+	reportMode, err := hid.ParseReportMode(setting.ReportMode)
+	if err != nil {
+		return nil, err
+	}
+	hidKeyboard.SetReportMode(reportMode)
+	for _, switchKey := range setting.SwitchKeys {
+		if switchKey.On == nil || *switchKey.On {
+			convCode.SetHIDRemap(uint8(switchKey.Src), uint8(switchKey.Dst))
+		}
+	}
+	if err := forEachConvKey(setting.ConvKeyMap, hidKeyboard.AddConvKey, log); err != nil {
+		return nil, err
+	}
+	for _, settingLayer := range setting.Layers {
+		layer := hidKeyboard.AddLayer(settingLayer.Name)
+		if err := forEachConvKey(settingLayer.ConvKeyMap, layer.AddConvKey, log); err != nil {
+			return nil, fmt.Errorf("Layers %s: %v", settingLayer.Name, err)
+		}
+	}
+	for _, layerKey := range setting.LayerKeys {
+		if layerKey.On != nil && !*layerKey.On {
+			continue
+		}
+		mode, err := engine.ParseLayerMode(layerKey.Mode)
+		if err == nil {
+			err = hidKeyboard.AddLayerKey(byte(layerKey.Key), layerKey.Layer, mode)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if layoutName == "" {
+		layoutName = setting.TextLayout
+	}
+	textLayout, err := engine.ParseTextLayout(layoutName)
+	if err != nil {
+		return nil, err
+	}
+	player := engine.NewMacroPlayer(time.Duration(setting.MacroIntervalMs) * time.Millisecond)
+	for _, settingMacro := range setting.Macros {
+		macro, err := settingMacro.toMacro(textLayout)
+		if err != nil {
+			return nil, err
+		}
+		player.Add(macro)
+	}
+	if err := checkMacroNames(setting, player); err != nil {
+		return nil, err
+	}
+	processor.SetMacroPlayer(player)
+
+	if setting.PhysicalLayout != "" {
+		physicalLayout, err := engine.ParseTextLayout(setting.PhysicalLayout)
+		if err != nil {
+			return nil, err
+		}
+		if physicalLayout != textLayout {
+			// ConvKeyMap の置き換えを優先するため、後から追加する
+			log.Infof("layout translation: %s -> %s", physicalLayout.Name, textLayout.Name)
+			translation := engine.NewLayoutTranslation(physicalLayout, textLayout)
+			for code, convKeyList := range translation {
+				for _, convKey := range convKeyList {
+					hidKeyboard.AddConvKey(code, convKey)
+				}
+			}
+		}
+	}
+
+	hotkeys := engine.NewHotkeyMatcher()
+	for _, settingHotkey := range setting.Hotkeys {
+		if settingHotkey.On != nil && !*settingHotkey.On {
+			continue
+		}
+		hotkey, err := settingHotkey.toHotkey()
+		if err != nil {
+			return nil, err
+		}
+		hotkeys.Add(hotkey)
+	}
+	if len(hotkeys.Hotkeys()) == 0 {
+		sequence := make([]uint8, len(default_exit_sequence))
+		for index, char := range default_exit_sequence {
+			sequence[index], _ = hid.ParseKeyName(string(char))
+		}
+		hotkeys.Add(engine.NewSequenceHotkey(sequence, engine.HotkeyAction_Exit))
+	}
+	processor.SetHotkeyMatcher(hotkeys)
+
+	// 組み合わせは物理的なキーの同時押しで判定するので、タップ・ホールドより先に処理する
+	comboStage := engine.NewComboStage(time.Duration(setting.ComboTermMs) * time.Millisecond)
+	for _, settingCombo := range setting.Combos {
+		if settingCombo.On != nil && !*settingCombo.On {
+			continue
+		}
+		combo, err := settingCombo.toCombo()
+		if err == nil && combo.Layer != nil && combo.Layer.Name != "" &&
+			hidKeyboard.GetLayer(combo.Layer.Name) == nil {
+			err = fmt.Errorf("unknown layer -- %s", combo.Layer.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		comboStage.Add(combo)
+	}
+	if comboStage.Len() > 0 {
+		processor.AddStage(comboStage)
+	}
+
+	tapHoldStage := engine.NewTapHoldStage()
+	for _, settingTapHold := range setting.TapHolds {
+		if settingTapHold.On != nil && !*settingTapHold.On {
+			continue
+		}
+		tapHold, err := settingTapHold.toTapHold()
+		if err == nil && tapHold.HoldLayer != "" &&
+			hidKeyboard.GetLayer(tapHold.HoldLayer) == nil {
+			err = fmt.Errorf("unknown layer -- %s", tapHold.HoldLayer)
+		}
+		if err != nil {
+			return nil, err
+		}
+		tapHoldStage.Add(tapHold)
+	}
+	if tapHoldStage.Len() > 0 {
+		processor.AddStage(tapHoldStage)
+	}
+
+	return &engine.Remapper{
+		Keyboard: hidKeyboard, Processor: processor, TextLayout: textLayout}, nil
+}
+
+// code が Keyboard/Keypad Page の usage でない場合はエラーを返す
+func hidCodeError(code uint8) error {
+	if _, has := hid.UsageName(code); !has {
+		return fmt.Errorf("HID code 0x%02x is out of the keyboard", code)
+	}
+	return nil
+}
+
+// value の全ての HIDCode と ConvKeyMap のキーを hidCodeError で検査する。
+//
+// path は value の位置で、エラーに "TapHolds[0].Tap" のように付ける。
+func checkHIDCodes(value reflect.Value, path string) error {
+	if value.Type() == hidCodeType {
+		if err := hidCodeError(uint8(value.Uint())); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			return checkHIDCodes(value.Elem(), path)
+		}
+	case reflect.Struct:
+		for index := 0; index < value.NumField(); index++ {
+			field := value.Type().Field(index)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := field.Name
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := checkHIDCodes(value.Field(index), name); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for index := 0; index < value.Len(); index++ {
+			if err := checkHIDCodes(
+				value.Index(index), fmt.Sprintf("%s[%d]", path, index)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if value.Type() != convKeyMapType {
+			return nil
+		}
+		keys := []string{}
+		for _, key := range value.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := fmt.Sprintf("%s[%q]", path, key)
+			// 不正なキー名は forEachConvKey で扱う
+			if code, err := hid.ParseKeyName(key); err == nil {
+				if err := hidCodeError(code); err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+			}
+			if err := checkHIDCodes(value.MapIndex(reflect.ValueOf(key)), name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
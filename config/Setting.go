@@ -0,0 +1,384 @@
+// Package config は、 config.json を読み込み、検査し、 engine の処理系を構築する。
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+	"github.com/ifritJP/hw-keyboard-remapper/input"
+	"github.com/ifritJP/hw-keyboard-remapper/output"
+)
+
+type SettingSwitchKey struct {
+	// 有効かどうか。 nil の場合は有効。
+	On *bool
+	// 置き換え元コード
+	Src hid.HIDCode
+	// 置き換え先コード
+	Dst hid.HIDCode
+}
+
+// 入力キーボードの選択条件のリスト。
+// config では、 1 つの名前の文字列か選択条件のオブジェクト、
+// あるいはそれらの配列で指定する。
+type DeviceSelectorList []input.DeviceSelector
+
+func (list *DeviceSelectorList) UnmarshalJSON(data []byte) error {
+	var selectors []input.DeviceSelector
+	if err := json.Unmarshal(data, &selectors); err != nil {
+		var selector input.DeviceSelector
+		if err := json.Unmarshal(data, &selector); err != nil {
+			return err
+		}
+		selectors = []input.DeviceSelector{selector}
+	}
+	*list = DeviceSelectorList{}
+	for _, selector := range selectors {
+		if !selector.IsEmpty() {
+			*list = append(*list, selector)
+		}
+	}
+	return nil
+}
+
+// レイヤーの設定
+type SettingLayer struct {
+	// レイヤー名
+	Name string
+	// このレイヤーが有効な時の置き換え。形式は Setting.ConvKeyMap と同じ。
+	ConvKeyMap map[string][]engine.ConvKeyInfo
+}
+
+// レイヤーを操作するキーの設定
+type SettingLayerKey struct {
+	// 有効かどうか。 nil の場合は有効。
+	On *bool
+	// レイヤーを操作するキーの HID コード
+	Key hid.HIDCode
+	// 操作対象のレイヤー名
+	Layer string
+	// "momentary" (デフォルト), "toggle", "lock" のいずれか
+	Mode string
+}
+
+// タップ・ホールドのキーの設定
+type SettingTapHold struct {
+	// 有効かどうか。 nil の場合は有効。
+	On *bool
+	// タップ・ホールドにするキーの HID コード
+	Key hid.HIDCode
+	// タップした時に送信する HID コード。 0 の場合は Key。
+	Tap hid.HIDCode
+	// ホールドした時に押す HID コード (モディファイア等)
+	Hold hid.HIDCode
+	// ホールドしている間 momentary で有効にするレイヤー名。 Hold とはどちらか一方を指定する。
+	HoldLayer string
+	// タップとホールドを区別する時間 (ms)。デフォルトは 200 ms。
+	TappingTermMs int
+	// タップ後にこの時間 (ms) 内に押し直すと、タップのキーを押し続ける。
+	// nil の場合は TappingTermMs と同じ。 0 の場合は無効。
+	QuickTapTermMs *int
+	// TappingTermMs 内でも、他のキーを押して離した場合はホールドにする
+	PermissiveHold bool
+	// TappingTermMs 内でも、他のキーを押した時点でホールドにする
+	HoldOnOtherKeyPress bool
+}
+
+// TapHold に変換する
+func (setting *SettingTapHold) toTapHold() (*engine.TapHold, error) {
+	if (setting.Hold == 0) == (setting.HoldLayer == "") {
+		return nil, fmt.Errorf(
+			"TapHolds: either Hold or HoldLayer is required -- key 0x%x", setting.Key)
+	}
+	tapHold := &engine.TapHold{
+		Key:                 byte(setting.Key),
+		Tap:                 byte(setting.Tap),
+		Hold:                byte(setting.Hold),
+		HoldLayer:           setting.HoldLayer,
+		TappingTerm:         time.Duration(setting.TappingTermMs) * time.Millisecond,
+		PermissiveHold:      setting.PermissiveHold,
+		HoldOnOtherKeyPress: setting.HoldOnOtherKeyPress,
+	}
+	if tapHold.Tap == 0 {
+		tapHold.Tap = tapHold.Key
+	}
+	if tapHold.TappingTerm <= 0 {
+		tapHold.TappingTerm = engine.DEFAULT_TAPPING_TERM
+	}
+	tapHold.QuickTapTerm = tapHold.TappingTerm
+	if setting.QuickTapTermMs != nil {
+		tapHold.QuickTapTerm = time.Duration(*setting.QuickTapTermMs) * time.Millisecond
+	}
+	return tapHold, nil
+}
+
+// 組み合わせの設定
+type SettingCombo struct {
+	// 有効かどうか。 nil の場合は有効。
+	On *bool
+	// 同時に押す HID コード。 2 つ以上指定する。
+	Keys []hid.HIDCode
+	// 組み合わせを押した時に押す HID コード
+	Code hid.HIDCode
+	// 組み合わせを押した時に操作するレイヤー名。 Code とはどちらか一方を指定する。
+	Layer string
+	// Layer の操作方法。 "momentary" (デフォルト), "toggle", "lock" のいずれか
+	LayerMode string
+}
+
+// Combo に変換する
+func (setting *SettingCombo) toCombo() (*engine.Combo, error) {
+	if len(setting.Keys) < 2 {
+		return nil, fmt.Errorf("Combos: at least 2 keys are required -- %v", setting.Keys)
+	}
+	if (setting.Code == 0) == (setting.Layer == "") {
+		return nil, fmt.Errorf("Combos: either Code or Layer is required -- %v", setting.Keys)
+	}
+	combo := &engine.Combo{Code: byte(setting.Code)}
+	for _, key := range setting.Keys {
+		if key == 0 {
+			return nil, fmt.Errorf("Combos: illegal key code -- %d", key)
+		}
+		if combo.Has(uint8(key)) {
+			return nil, fmt.Errorf("Combos: duplicated key code -- %d", key)
+		}
+		combo.Keys = append(combo.Keys, uint8(key))
+	}
+	if setting.Layer != "" {
+		mode, err := engine.ParseLayerMode(setting.LayerMode)
+		if err != nil {
+			return nil, err
+		}
+		combo.Layer = &engine.LayerAction{Name: setting.Layer, Mode: mode}
+	}
+	return combo, nil
+}
+
+// マクロの 1 操作の設定。いずれか 1 つを指定する。
+type SettingMacroStep struct {
+	// 押す HID コード
+	Press hid.HIDCode `json:"press"`
+	// 離す HID コード
+	Release hid.HIDCode `json:"release"`
+	// 押して離す HID コード
+	Tap hid.HIDCode `json:"tap"`
+	// 待ち時間 (ms)
+	Delay int `json:"delay"`
+	// 入力する文字列
+	Text string `json:"text"`
+}
+
+// マクロの設定
+type SettingMacro struct {
+	// ConvKeyMap の "macro" で指定する名前
+	Name  string
+	Steps []SettingMacroStep
+}
+
+// Macro に変換する。 Text は layout で入力するキー操作に変換する。
+func (setting *SettingMacro) toMacro(layout *engine.TextLayout) (*engine.Macro, error) {
+	if setting.Name == "" {
+		return nil, fmt.Errorf("Macros: Name is required")
+	}
+	macro := &engine.Macro{Name: setting.Name}
+	for index, settingStep := range setting.Steps {
+		steps := []engine.MacroStep{}
+		if settingStep.Press != 0 {
+			steps = append(steps, engine.MacroStep{Kind: engine.MacroStep_Press, Code: byte(settingStep.Press)})
+		}
+		if settingStep.Release != 0 {
+			steps = append(steps, engine.MacroStep{
+				Kind: engine.MacroStep_Release, Code: byte(settingStep.Release)})
+		}
+		if settingStep.Tap != 0 {
+			steps = append(steps, engine.MacroStep{Kind: engine.MacroStep_Tap, Code: byte(settingStep.Tap)})
+		}
+		if settingStep.Delay > 0 {
+			steps = append(steps, engine.MacroStep{
+				Kind:  engine.MacroStep_Delay,
+				Delay: time.Duration(settingStep.Delay) * time.Millisecond})
+		}
+		if settingStep.Text != "" {
+			strokes, err := layout.KeyStrokes(settingStep.Text)
+			if err != nil {
+				return nil, fmt.Errorf("Macros: %s: %v", setting.Name, err)
+			}
+			steps = append(steps, engine.MacroStep{Kind: engine.MacroStep_Text, Strokes: strokes})
+		}
+		if len(steps) != 1 {
+			return nil, fmt.Errorf(
+				"Macros: %s: step %d must have one of press, release, tap, delay, text",
+				setting.Name, index)
+		}
+		macro.Steps = append(macro.Steps, steps[0])
+	}
+	return macro, nil
+}
+
+// ホットキーの設定。 Sequence か Chord のどちらか一方を指定する。
+type SettingHotkey struct {
+	// 有効かどうか。 nil の場合は有効。
+	On *bool
+	// 順に押すキー
+	Sequence []hid.HIDCode
+	// 同時に押すキー
+	Chord []hid.HIDCode
+	// Chord を押し続ける時間 (ms)。 0 の場合は揃った時点で実行する。
+	HoldMs int
+	// "exit" (デフォルト), "pause", "reload", "bypass" のいずれか
+	Action string
+}
+
+// Hotkey に変換する
+func (setting *SettingHotkey) toHotkey() (*engine.Hotkey, error) {
+	action, err := engine.ParseHotkeyAction(setting.Action)
+	if err != nil {
+		return nil, err
+	}
+	if (len(setting.Sequence) == 0) == (len(setting.Chord) == 0) {
+		return nil, fmt.Errorf("Hotkeys: either Sequence or Chord is required")
+	}
+	keys := setting.Sequence
+	if len(setting.Chord) > 0 {
+		keys = setting.Chord
+	}
+	codes := make([]uint8, len(keys))
+	for index, key := range keys {
+		codes[index] = uint8(key)
+	}
+	if len(setting.Chord) > 0 {
+		return engine.NewChordHotkey(
+			codes, time.Duration(setting.HoldMs)*time.Millisecond, action), nil
+	}
+	return engine.NewSequenceHotkey(codes, action), nil
+}
+
+type Setting struct {
+	// config の説明。処理には使用しない。
+	Comments []string
+	// 入力に使用するキーボード。
+	// 複数指定した場合は、全てのキーボードの入力を 1 つの HID キーボードにまとめる。
+	InputKeyboardName DeviceSelectorList
+	// キーボードのレポート形式。 "boot" (デフォルト) か "nkro"。
+	// -mode gadget-setup は、この形式の report descriptor で gadget を構築する。
+	//
+	// ホストが選択したプロトコルは検出しないので、 "nkro" は BIOS/UEFI 等の
+	// boot protocol しか扱えないホストでは使えない。 OS だけで使う場合に選択すること。
+	ReportMode string
+	// -mode gadget-setup で構築する USB gadget の設定
+	Gadget     output.GadgetSetting
+	SwitchKeys []SettingSwitchKey
+	// HID コード → 置き換え。 HID コードは数値の文字列かキー名。
+	ConvKeyMap map[string][]engine.ConvKeyInfo
+	// レイヤー。後のものほど優先度が高い。
+	Layers []SettingLayer
+	// レイヤーを操作するキー
+	LayerKeys []SettingLayerKey
+	// タップ・ホールドのキー
+	TapHolds []SettingTapHold
+	// 組み合わせのキーを同時押しと見なす時間 (ms)。デフォルトは 50 ms。
+	ComboTermMs int
+	// 同時に押すと別のキーになる組み合わせ
+	Combos []SettingCombo
+	// ホストのキーボードレイアウト。 "us" (デフォルト), "jis", "de" のいずれか。
+	// マクロの text と -mode type で、文字を入力するキーの選択に使用する。
+	TextLayout string
+	// 物理キーボードの刻印のレイアウト。 "us", "jis", "de" のいずれか。
+	// TextLayout と異なる場合、刻印通りの記号がホストに入力されるように、
+	// キーと Shift の状態を置き換える。空の場合は置き換えない。
+	PhysicalLayout string
+	// 外部から操作するための unix ドメインソケットのパス。空の場合は作成しない。
+	ControlSocket string
+	// キーイベントの入力元。 "evdev" (デフォルト), "replay:<path>", "stdin",
+	// "tcp:<addr>", "unix:<path>" のいずれか。 -input で上書きする。
+	Input string
+	// レポートの出力先。 "hidg" (デフォルト), "uinput", "file:<path>" のいずれか。
+	// -output で上書きする。
+	Output string
+	// ホットキー。指定しない場合は q w e を 4 回押すと終了する。
+	// キーは SwitchKeys で置き換える前の物理キーで指定する。
+	Hotkeys []SettingHotkey
+	// マクロのレポートの送信間隔 (ms)。デフォルトは 10 ms。
+	MacroIntervalMs int
+	// マクロ。 ConvKeyMap の "macro" で、キーに割り当てる。
+	Macros []SettingMacro
+}
+
+// convKeyMap の有効な ConvKeyInfo 毎に add を呼び出す。
+//
+// キー名が不正なものは log に出力して無視する。
+// "CapsLock" と "57" の様に同じ HID キーコードのキーがある場合は、
+// 置き換えの順番が決まらないのでエラーにする。
+func forEachConvKey(
+	convKeyMap map[string][]engine.ConvKeyInfo,
+	add func(code byte, convKey *engine.ConvKeyInfo), log engine.Logger) error {
+	codeTxtList := make([]string, 0, len(convKeyMap))
+	for codeTxt := range convKeyMap {
+		codeTxtList = append(codeTxtList, codeTxt)
+	}
+	sort.Strings(codeTxtList)
+	code2txt := map[uint8]string{}
+	for _, codeTxt := range codeTxtList {
+		code, err := hid.ParseKeyName(codeTxt)
+		if err != nil {
+			log.Warnf("%v", err)
+			continue
+		}
+		if prev, has := code2txt[code]; has {
+			return fmt.Errorf(
+				"ConvKeyMap: %q and %q are the same key %s", prev, codeTxt, hid.KeyName(code))
+		}
+		code2txt[code] = codeTxt
+		for _, convKey := range convKeyMap[codeTxt] {
+			if convKey.On == nil || *convKey.On {
+				// add() する ConvKeyInfo 情報のオブジェクトを
+				// 別々にするため、 cloneConvKey を作る。
+				cloneConvKey := convKey
+				add(byte(code), &cloneConvKey)
+			}
+		}
+	}
+	return nil
+}
+
+// ConvKeyMap で指定したマクロが player にあるかどうかを確認する
+func checkMacroNames(setting *Setting, player *engine.MacroPlayer) error {
+	convKeyMaps := []map[string][]engine.ConvKeyInfo{setting.ConvKeyMap}
+	for _, layer := range setting.Layers {
+		convKeyMaps = append(convKeyMaps, layer.ConvKeyMap)
+	}
+	for _, convKeyMap := range convKeyMaps {
+		for _, convKeyList := range convKeyMap {
+			for _, convKey := range convKeyList {
+				if convKey.Macro != "" && player.Get(convKey.Macro) == nil {
+					return fmt.Errorf("unknown macro -- %s", convKey.Macro)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// path の config を読み込む
+func Load(path string) (*Setting, error) {
+	fileObj, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo, err := os.Stat(path); err != nil {
+		return nil, err
+	} else {
+		buf := make([]byte, fileInfo.Size())
+		if _, err := fileObj.Read(buf); err != nil {
+			return nil, err
+		}
+		var setting Setting
+		err := json.Unmarshal(buf, &setting)
+		return &setting, err
+	}
+}
@@ -0,0 +1,294 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import "time"
+
+const DEFAULT_COMBO_TERM = 50 * time.Millisecond
+
+// 同時に押すと別のキーになるキーの組み合わせ
+type Combo struct {
+	// 組み合わせる HID コード
+	Keys []uint8
+	// 組み合わせを押した時に押す HID コード。 Layer を指定した場合は使用しない。
+	Code byte
+	// 組み合わせを押した時のレイヤー操作
+	Layer *LayerAction
+}
+
+// code が組み合わせのキーかどうか
+func (combo *Combo) Has(code uint8) bool {
+	for _, key := range combo.Keys {
+		if key == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (combo *Combo) event(pressed bool, at time.Time) PipelineEvent {
+	if combo.Layer != nil {
+		return PipelineEvent{Pressed: pressed, Time: at, Layer: combo.Layer}
+	}
+	return PipelineEvent{HidCode: combo.Code, Pressed: pressed, Time: at}
+}
+
+// 押されている組み合わせ
+type activeCombo struct {
+	combo *Combo
+	// 押されたままの組み合わせのキー
+	held map[uint8]bool
+	// 組み合わせのリリースを送信したかどうか
+	released bool
+}
+
+// 組み合わせを処理するステージ。
+//
+// 組み合わせのキーが押されてから Term の間はイベントをバッファし、
+// 組み合わせが確定したら組み合わせのイベントに置き換える。
+// 組み合わせにならなかったイベントは、元の順番で流す。
+// 組み合わせは、いずれかのキーを離した時点でリリースする。
+type ComboStage struct {
+	combos []*Combo
+	// 組み合わせのキーを押してから、他のキーを待つ時間
+	Term   time.Duration
+	buffer []PipelineEvent
+	active []*activeCombo
+	log    Logger
+}
+
+func NewComboStage(term time.Duration) *ComboStage {
+	if term <= 0 {
+		term = DEFAULT_COMBO_TERM
+	}
+	return &ComboStage{Term: term, log: NopLogger{}}
+}
+
+func (stage *ComboStage) Add(combo *Combo) {
+	stage.combos = append(stage.combos, combo)
+}
+
+func (stage *ComboStage) setLogger(log Logger) {
+	stage.log = log
+}
+
+func (stage *ComboStage) Len() int {
+	return len(stage.combos)
+}
+
+// code を含む組み合わせがあるかどうか
+func (stage *ComboStage) isComboKey(code uint8) bool {
+	for _, combo := range stage.combos {
+		if combo.Has(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// buffer で押されたままのキーを、押された順に返す
+func heldKeys(buffer []PipelineEvent) []uint8 {
+	held := []uint8{}
+	for _, event := range buffer {
+		if event.Layer != nil {
+			continue
+		}
+		index := -1
+		for pos, code := range held {
+			if code == event.HidCode {
+				index = pos
+			}
+		}
+		if event.Pressed && index < 0 {
+			held = append(held, event.HidCode)
+		} else if !event.Pressed && index >= 0 {
+			held = append(held[:index], held[index+1:]...)
+		}
+	}
+	return held
+}
+
+// keys を全て含み、 keys より多いキーの組み合わせがあるかどうか
+func (stage *ComboStage) hasLongerCombo(keys []uint8) bool {
+	for _, combo := range stage.combos {
+		if len(combo.Keys) <= len(keys) {
+			continue
+		}
+		contains := true
+		for _, code := range keys {
+			if !combo.Has(code) {
+				contains = false
+				break
+			}
+		}
+		if contains {
+			return true
+		}
+	}
+	return false
+}
+
+func (stage *ComboStage) Process(event PipelineEvent) []PipelineEvent {
+	events := stage.Expire(event.Time)
+	if event.Layer != nil {
+		if len(stage.buffer) > 0 {
+			stage.buffer = append(stage.buffer, event)
+			return events
+		}
+		return append(events, event)
+	}
+	if len(stage.buffer) == 0 {
+		if !event.Pressed {
+			if released, has := stage.releaseActive(event); has {
+				return append(events, released...)
+			}
+		}
+		if !event.Pressed || !stage.isComboKey(event.HidCode) {
+			return append(events, event)
+		}
+		stage.buffer = []PipelineEvent{event}
+		return events
+	}
+
+	if event.Pressed {
+		if containsCode(heldKeys(stage.buffer), event.HidCode) {
+			// キーリピート
+			return events
+		}
+		stage.buffer = append(stage.buffer, event)
+		if stage.hasLongerCombo(heldKeys(stage.buffer)) {
+			// まだ組み合わせのキーが押される可能性がある
+			return events
+		}
+		return append(events, stage.resolve()...)
+	}
+	stage.buffer = append(stage.buffer, event)
+	for _, buffered := range stage.buffer {
+		if buffered.Pressed && buffered.sameKey(&event) {
+			// 組み合わせのキーが Term 内に離されたので、その時点で確定する
+			stage.buffer = stage.buffer[:len(stage.buffer)-1]
+			events = append(events, stage.resolve()...)
+			return append(events, stage.Process(event)...)
+		}
+	}
+	return events
+}
+
+// event が押されている組み合わせのキーのリリースの場合、処理して true を返す。
+func (stage *ComboStage) releaseActive(event PipelineEvent) ([]PipelineEvent, bool) {
+	for index, active := range stage.active {
+		if !active.held[event.HidCode] {
+			continue
+		}
+		delete(active.held, event.HidCode)
+		events := []PipelineEvent{}
+		if !active.released {
+			active.released = true
+			events = append(events, active.combo.event(false, event.Time))
+		}
+		if len(active.held) == 0 {
+			stage.active = append(stage.active[:index], stage.active[index+1:]...)
+		}
+		return events, true
+	}
+	return nil, false
+}
+
+// バッファを確定する。
+//
+// 押されたままのキーで成立する最も長い組み合わせを押す。
+// 組み合わせが揃う前の他のイベントは元の順番で組み合わせより先に流し、
+// 揃った後のイベントは処理し直す。組み合わせが成立しない場合は、
+// 先頭のイベントを流して残りを処理し直す。
+func (stage *ComboStage) resolve() []PipelineEvent {
+	buffer := stage.buffer
+	stage.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+	held := heldKeys(buffer)
+	var match *Combo
+	for _, combo := range stage.combos {
+		if match != nil && len(combo.Keys) <= len(match.Keys) {
+			continue
+		}
+		all := true
+		for _, code := range combo.Keys {
+			if !containsCode(held, code) {
+				all = false
+				break
+			}
+		}
+		if all {
+			match = combo
+		}
+	}
+
+	events := []PipelineEvent{}
+	rest := buffer[1:]
+	if match == nil {
+		events = append(events, buffer[0])
+	} else {
+		stage.log.Debugf("combo %v", match.Keys)
+		active := &activeCombo{combo: match, held: map[uint8]bool{}}
+		rest = []PipelineEvent{}
+		for _, event := range buffer {
+			if event.Layer == nil && event.Pressed && match.Has(event.HidCode) &&
+				!active.held[event.HidCode] && len(active.held) < len(match.Keys) {
+				active.held[event.HidCode] = true
+				if len(active.held) == len(match.Keys) {
+					events = append(events, match.event(true, event.Time))
+				}
+				continue
+			}
+			if len(active.held) < len(match.Keys) {
+				events = append(events, stage.pass(event)...)
+			} else {
+				rest = append(rest, event)
+			}
+		}
+		stage.active = append(stage.active, active)
+	}
+	for _, event := range rest {
+		events = append(events, stage.Process(event)...)
+	}
+	return events
+}
+
+// バッファせずに event を流す。押されている組み合わせのキーのリリースは置き換える。
+func (stage *ComboStage) pass(event PipelineEvent) []PipelineEvent {
+	if event.Layer == nil && !event.Pressed {
+		if released, has := stage.releaseActive(event); has {
+			return released
+		}
+	}
+	return []PipelineEvent{event}
+}
+
+func containsCode(codes []uint8, code uint8) bool {
+	for _, val := range codes {
+		if val == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (stage *ComboStage) Expire(now time.Time) []PipelineEvent {
+	if deadline, has := stage.Deadline(); has && !now.Before(deadline) {
+		return stage.resolve()
+	}
+	return nil
+}
+
+func (stage *ComboStage) Deadline() (time.Time, bool) {
+	if len(stage.buffer) == 0 {
+		return time.Time{}, false
+	}
+	return stage.buffer[0].Time.Add(stage.Term), true
+}
+
+func (stage *ComboStage) Reset() {
+	stage.buffer = nil
+	stage.active = nil
+}
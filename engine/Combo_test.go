@@ -0,0 +1,105 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"testing"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+func TestCombo(t *testing.T) {
+	// J+K で esc、 J+K+L で tab
+	jk := &Combo{Keys: []uint8{hid.KEY_J, hid.KEY_K}, Code: hid.KEY_ESCAPE}
+	jkl := &Combo{Keys: []uint8{hid.KEY_J, hid.KEY_K, hid.KEY_L}, Code: hid.KEY_Tab}
+	cases := []struct {
+		name     string
+		combos   []*Combo
+		inputs   []simInput
+		expected []string
+	}{
+		{
+			// いずれかのキーを離した時点で組み合わせを離す
+			"combo", []*Combo{jk},
+			[]simInput{
+				down(0, hid.KEY_J), down(20, hid.KEY_K), up(100, hid.KEY_J), up(110, hid.KEY_K)},
+			[]string{"20 esc", "100 -"},
+		},
+		{
+			"reverse order", []*Combo{jk},
+			[]simInput{
+				down(0, hid.KEY_K), down(20, hid.KEY_J), up(100, hid.KEY_K), up(110, hid.KEY_J)},
+			[]string{"20 esc", "100 -"},
+		},
+		{
+			// ComboTerm 内に揃わない場合は元のキー
+			"timeout", []*Combo{jk},
+			[]simInput{down(0, hid.KEY_J), down(80, hid.KEY_K), up(200, hid.KEY_K), up(210, hid.KEY_J)},
+			[]string{"50 j", "130 j+k", "200 j", "210 -"},
+		},
+		{
+			// 組み合わせ以外のキーを押すと、組み合わせにしない
+			"interrupted", []*Combo{jk},
+			[]simInput{
+				down(0, hid.KEY_J), down(10, hid.KEY_X), up(20, hid.KEY_X), up(30, hid.KEY_J)},
+			[]string{"10 j", "10 j+x", "20 j", "30 -"},
+		},
+		{
+			// 組み合わせが揃う前のイベントは、組み合わせより先に元の順番で流す
+			"buffered event before combo", []*Combo{jk},
+			[]simInput{
+				down(0, hid.KEY_X), down(100, hid.KEY_J), up(110, hid.KEY_X), down(120, hid.KEY_K),
+				up(200, hid.KEY_K), up(210, hid.KEY_J)},
+			[]string{"0 x", "120 -", "120 esc", "200 -"},
+		},
+		{
+			"longer combo", []*Combo{jk, jkl},
+			[]simInput{
+				down(0, hid.KEY_J), down(10, hid.KEY_K), down(20, hid.KEY_L),
+				up(100, hid.KEY_J), up(110, hid.KEY_K), up(120, hid.KEY_L)},
+			[]string{"20 tab", "100 -"},
+		},
+		{
+			// 長い組み合わせを待ち、 ComboTerm 後に短い組み合わせにする
+			"shorter combo after term", []*Combo{jk, jkl},
+			[]simInput{
+				down(0, hid.KEY_J), down(10, hid.KEY_K), up(100, hid.KEY_J), up(110, hid.KEY_K)},
+			[]string{"50 esc", "100 -"},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			proc := newTestProcessor()
+			stage := NewComboStage(DEFAULT_COMBO_TERM)
+			for _, combo := range testCase.combos {
+				stage.Add(combo)
+			}
+			proc.AddStage(stage)
+			checkStream(t, simulateKeyboard(t, proc, testCase.inputs...), testCase.expected...)
+		})
+	}
+}
+
+func TestComboLayer(t *testing.T) {
+	proc := newTestProcessor()
+	keyboard := proc.GetKeyboard()
+	keyboard.AddLayer("nav").AddConvKey(hid.KEY_H, &ConvKeyInfo{Code: hid.KEY_LeftArrow})
+	stage := NewComboStage(DEFAULT_COMBO_TERM)
+	stage.Add(&Combo{
+		Keys:  []uint8{hid.KEY_D, hid.KEY_F},
+		Layer: &LayerAction{"nav", LayerMode_Toggle},
+	})
+	proc.AddStage(stage)
+
+	stream := simulateKeyboard(t, proc,
+		// D+F でレイヤーを切り替える
+		down(0, hid.KEY_D), down(10, hid.KEY_F), up(20, hid.KEY_D), up(30, hid.KEY_F),
+		down(100, hid.KEY_H), up(110, hid.KEY_H),
+		down(200, hid.KEY_D), down(210, hid.KEY_F), up(220, hid.KEY_D), up(230, hid.KEY_F),
+		down(300, hid.KEY_H), up(310, hid.KEY_H),
+	)
+	checkStream(t, stream,
+		"10 -", "20 -", "100 left", "110 -",
+		"210 -", "220 -", "300 h", "310 -",
+	)
+}
@@ -0,0 +1,384 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+	"github.com/ifritJP/hw-keyboard-remapper/report"
+)
+
+type ConvKeyInfo struct {
+	On *bool
+	// HID の modifier の一致条件。
+	// HID の modifier と以下の式が成立する時に、このキーに置き換える。
+	// (modifier & condModifierMask) == condModifierResult
+	CondModifierMask   hid.ModifierBits `json:"modMask"`
+	CondModifierResult hid.ModifierBits `json:"modResult"`
+	// ホストのロック状態 (LED) の一致条件。
+	// (lockState & condLockMask) == condLockResult の時に置き換える。
+	CondLockMask   hid.LedState `json:"lockMask"`
+	CondLockResult hid.LedState `json:"lockResult"`
+	// HID コード
+	Code hid.HIDCode
+	// Consumer Page の usage。 0 以外の場合、 Code の代わりにこの usage を送信する。
+	Consumer uint16 `json:"consumer"`
+	// System Control の usage (0x81-0x83)。
+	// 0 以外の場合、 Code の代わりにこの usage を送信する。
+	System byte `json:"system"`
+	// modifier に XOR する値
+	ModifierXor hid.ModifierBits `json:"modXor"`
+	// マクロ名。指定した場合、キーを押した時にこのマクロを再生する。
+	Macro string `json:"macro"`
+}
+
+// 条件を満す状態があるかどうか
+func (info *ConvKeyInfo) Satisfiable() bool {
+	return info.CondModifierResult&^info.CondModifierMask == 0 &&
+		info.CondLockResult&^info.CondLockMask == 0
+}
+
+// other の条件に一致する状態で、常に info の条件にも一致するかどうか
+func (info *ConvKeyInfo) Covers(other *ConvKeyInfo) bool {
+	return info.CondModifierMask&^other.CondModifierMask == 0 &&
+		other.CondModifierResult&info.CondModifierMask == info.CondModifierResult &&
+		info.CondLockMask&^other.CondLockMask == 0 &&
+		other.CondLockResult&info.CondLockMask == info.CondLockResult
+}
+
+// other と条件が同じかどうか
+func (info *ConvKeyInfo) SameCondition(other *ConvKeyInfo) bool {
+	return info.CondModifierMask == other.CondModifierMask &&
+		info.CondModifierResult == other.CondModifierResult &&
+		info.CondLockMask == other.CondLockMask &&
+		info.CondLockResult == other.CondLockResult
+}
+
+// 置き換え後の出力先
+type hidTarget struct {
+	// キーボードの HID キーコード
+	code byte
+	// Consumer Page の usage
+	consumer uint16
+	// System Control の usage
+	system byte
+	// 再生するマクロ名
+	macro string
+}
+
+// HID のキーの状態
+type HIDKeyInfo struct {
+	// HID キーコード
+	OrgCode byte
+	// キーコード名
+	Name string
+	// modifier キーかどうか
+	IsModifier bool
+	// 押されているかどうか
+	Pressed bool
+	// ConvKeyInfo
+	convKeyInfoList []*ConvKeyInfo
+	// 押された時に有効だったレイヤーの ConvKeyInfo。
+	// レイヤーは押された時点で決定し、離すまで維持する。
+	layerConvKeyInfoList []*ConvKeyInfo
+}
+
+// HID の modifier bit を返す
+func (info *HIDKeyInfo) GetModifierBit() uint8 {
+	if info.Pressed && info.IsModifier {
+		return 1 << (info.OrgCode - 0xe0)
+	}
+	return 0
+}
+
+// 置き換えを処理する。
+//
+// @param modifierFlag 置き換え前の modifierFlag
+// @param lockState ホストのロック状態
+// @param bypass true の場合は置き換えない
+// @return hidTarget 置き換え後の出力先
+// @return byte 置き換え後の modifierFlag
+func (info *HIDKeyInfo) process(
+	modifierFlag byte, lockState hid.LedState, bypass bool) (hidTarget, byte) {
+	if bypass {
+		if !info.IsModifier {
+			return hidTarget{code: info.OrgCode}, modifierFlag
+		}
+		return hidTarget{}, modifierFlag
+	}
+	// レイヤーの置き換えを優先し、一致しない場合は基本の置き換えを使う
+	convKeyInfoList := info.convKeyInfoList
+	if len(info.layerConvKeyInfoList) > 0 {
+		convKeyInfoList = append(
+			append([]*ConvKeyInfo{}, info.layerConvKeyInfoList...),
+			info.convKeyInfoList...)
+	}
+	for _, convKey := range convKeyInfoList {
+		// 置き換え情報を処理する
+		if (modifierFlag&byte(convKey.CondModifierMask)) == byte(convKey.CondModifierResult) &&
+			(lockState&convKey.CondLockMask) == convKey.CondLockResult {
+			modifierFlag = modifierFlag ^ byte(convKey.ModifierXor)
+			if convKey.Consumer != 0 {
+				return hidTarget{consumer: convKey.Consumer}, modifierFlag
+			}
+			if convKey.System != 0 {
+				return hidTarget{system: convKey.System}, modifierFlag
+			}
+			if convKey.Macro != "" {
+				return hidTarget{macro: convKey.Macro}, modifierFlag
+			}
+			return hidTarget{code: byte(convKey.Code)}, modifierFlag
+		}
+	}
+	if !info.IsModifier {
+		return hidTarget{code: info.OrgCode}, modifierFlag
+	}
+	return hidTarget{}, modifierFlag
+}
+
+type HIDKeyboard struct {
+	// HID レポートを作成する
+	builder *report.Builder
+	// HID キーコード → HIDKeyInfo
+	keyInfoMap map[uint8]*HIDKeyInfo
+	// 押されている HID キーコードを押された順に保持する
+	pressedOrder []uint8
+	// ホストのロック状態
+	lockState hid.LedState
+	// 直接押されている Consumer Page の usage
+	consumerState report.UsageState
+	// ConvKeyInfo の置き換えで押されている Consumer Page の usage
+	convConsumer uint16
+	// 直接押されている System Control の usage
+	systemState report.UsageState
+	// ConvKeyInfo の置き換えで押されている System Control の usage
+	convSystem byte
+	// レイヤー。後のものほど優先度が高い。
+	layers []*Layer
+	// HID キーコード → レイヤーを操作するキー
+	layerKeys map[uint8]*layerKey
+	// 押されているレイヤーを操作するキー
+	pressedLayerKeys map[uint8]bool
+	// 再生中のマクロが押しているキー
+	macro macroState
+	// true の場合は ConvKeyMap とレイヤーを使わずに、キーをそのまま送信する
+	bypass bool
+	log    Logger
+}
+
+func NewHIDKeyInfo(code byte, name string, modifier bool) *HIDKeyInfo {
+	return &HIDKeyInfo{code, name, modifier, false, []*ConvKeyInfo{}, nil}
+}
+
+func NewHIDKeyboard() *HIDKeyboard {
+	keyInfoMap := map[uint8]*HIDKeyInfo{}
+	for _, code := range hid.UsageCodes() {
+		name, _ := hid.UsageName(code)
+		keyInfoMap[code] = NewHIDKeyInfo(code, name, hid.IsModifierCode(code))
+	}
+	return &HIDKeyboard{
+		builder:      report.NewBuilder(),
+		keyInfoMap:   keyInfoMap,
+		pressedOrder: []uint8{},
+		log:          NopLogger{},
+
+		layerKeys:        map[uint8]*layerKey{},
+		pressedLayerKeys: map[uint8]bool{},
+	}
+}
+
+// code のキーを押す。 usage 名の無い HID キーコードは無視する。
+func (keyboard *HIDKeyboard) PressKey(code uint8) {
+	keyInfo := keyboard.keyInfoMap[code]
+	if keyInfo == nil {
+		return
+	}
+	if !keyInfo.Pressed {
+		// キーリピートで押下が続く場合は、最初に押された位置を維持する
+		keyboard.pressedOrder = append(keyboard.pressedOrder, code)
+		keyInfo.layerConvKeyInfoList = keyboard.resolveLayerConvKey(code)
+	}
+	keyInfo.Pressed = true
+}
+
+// code のキーを離す。 usage 名の無い HID キーコードは無視する。
+func (keyboard *HIDKeyboard) ReleaseKey(code uint8) {
+	keyInfo := keyboard.keyInfoMap[code]
+	if keyInfo == nil {
+		return
+	}
+	keyInfo.Pressed = false
+	keyInfo.layerConvKeyInfoList = nil
+	for index, pressedCode := range keyboard.pressedOrder {
+		if pressedCode == code {
+			keyboard.pressedOrder = append(
+				keyboard.pressedOrder[:index], keyboard.pressedOrder[index+1:]...)
+			break
+		}
+	}
+}
+
+func (keyboard *HIDKeyboard) ReleaseAllKeys() {
+	for _, keyInfo := range keyboard.keyInfoMap {
+		keyInfo.Pressed = false
+		keyInfo.layerConvKeyInfoList = nil
+	}
+	keyboard.pressedOrder = keyboard.pressedOrder[:0]
+	keyboard.releaseMomentaryLayers()
+	keyboard.consumerState.ReleaseAll()
+	keyboard.systemState.ReleaseAll()
+	keyboard.macro = macroState{}
+}
+
+// マクロが押しているキーを設定する
+func (keyboard *HIDKeyboard) setMacroState(state macroState) {
+	keyboard.macro = state
+}
+
+// code のキーの置き換えがマクロの場合、マクロ名を返す。
+func (keyboard *HIDKeyboard) GetMacroName(code uint8) string {
+	modifierFlag := uint8(0)
+	for _, pressedCode := range keyboard.pressedOrder {
+		modifierFlag |= keyboard.keyInfoMap[pressedCode].GetModifierBit()
+	}
+	keyInfo := keyboard.keyInfoMap[code]
+	if keyInfo == nil {
+		return ""
+	}
+	target, _ := keyInfo.process(modifierFlag, keyboard.lockState, keyboard.bypass)
+	return target.macro
+}
+
+// Consumer Page の usage を押す
+func (keyboard *HIDKeyboard) PressConsumer(usage uint16) {
+	keyboard.consumerState.Press(usage)
+}
+
+// Consumer Page の usage を離す
+func (keyboard *HIDKeyboard) ReleaseConsumer(usage uint16) {
+	keyboard.consumerState.Release(usage)
+}
+
+// System Control の usage を押す
+func (keyboard *HIDKeyboard) PressSystem(usage byte) {
+	keyboard.systemState.Press(uint16(usage))
+}
+
+// System Control の usage を離す
+func (keyboard *HIDKeyboard) ReleaseSystem(usage byte) {
+	keyboard.systemState.Release(uint16(usage))
+}
+
+// キーボードのレポート形式を設定する
+func (keyboard *HIDKeyboard) SetReportMode(mode hid.ReportMode) {
+	keyboard.builder.SetReportMode(mode)
+}
+
+// 設定されたキーボードのレポート形式を返す
+func (keyboard *HIDKeyboard) GetReportMode() hid.ReportMode {
+	return keyboard.builder.GetReportMode()
+}
+
+// バイパスするかどうかを設定する
+func (keyboard *HIDKeyboard) SetBypass(bypass bool) {
+	keyboard.bypass = bypass
+}
+
+// ホストのロック状態を設定する
+func (keyboard *HIDKeyboard) SetLockState(state hid.LedState) {
+	keyboard.lockState = state
+}
+
+// ホストのロック状態を返す
+func (keyboard *HIDKeyboard) GetLockState() hid.LedState {
+	return keyboard.lockState
+}
+
+// code の HIDKeyInfo を返す。 usage 名の無い HID キーコードの場合は nil。
+func (keyboard *HIDKeyboard) GetKeyInfo(code uint8) *HIDKeyInfo {
+	return keyboard.keyInfoMap[code]
+}
+
+// code のキーが押されているかどうか
+func (keyboard *HIDKeyboard) IsPressed(code uint8) bool {
+	keyInfo := keyboard.keyInfoMap[code]
+	return keyInfo != nil && keyInfo.Pressed
+}
+
+// code のキーの置き換えを追加する。 usage 名の無い HID キーコードは無視する。
+func (keyboard *HIDKeyboard) AddConvKey(code byte, convKey *ConvKeyInfo) {
+	keyInfo := keyboard.GetKeyInfo(code)
+	if keyInfo == nil {
+		keyboard.log.Warnf("unknown HID code 0x%02x", code)
+		return
+	}
+	keyInfo.convKeyInfoList = append(keyInfo.convKeyInfoList, convKey)
+}
+
+// 押されているキーの置き換え等を処理し、送信する modifier と HID キーコードを返す。
+//
+// キーは押された順に返すので、 ReportMode_Boot の場合、
+// 押下中のキーの位置はパケット間で変わらない。
+func (keyboard *HIDKeyboard) resolveKeys() (byte, []byte) {
+	orgModifierFlag := uint8(0)
+	// modifier をセットする
+	for _, code := range keyboard.pressedOrder {
+		orgModifierFlag = orgModifierFlag | keyboard.keyInfoMap[code].GetModifierBit()
+	}
+	// キーの置き換え等を処理する
+	modifierFlag := orgModifierFlag
+	codes := make([]byte, 0, len(keyboard.pressedOrder))
+	keyboard.convConsumer = 0
+	keyboard.convSystem = 0
+	for _, pressedCode := range keyboard.pressedOrder {
+		keyInfo := keyboard.keyInfoMap[pressedCode]
+		target := hidTarget{}
+		target, modifierFlag = keyInfo.process(modifierFlag, keyboard.lockState, keyboard.bypass)
+		if target.consumer > 0 {
+			keyboard.convConsumer = target.consumer
+		}
+		if target.system > 0 {
+			keyboard.convSystem = target.system
+		}
+		if target.code > 0 {
+			codes = append(codes, target.code)
+		}
+	}
+	// マクロが押しているキーを加える
+	if keyboard.macro.override {
+		modifierFlag = keyboard.macro.modifier
+	} else {
+		modifierFlag |= keyboard.macro.modifier
+	}
+	for _, code := range keyboard.macro.codes {
+		if !containsCode(codes, code) {
+			codes = append(codes, code)
+		}
+	}
+	return modifierFlag, codes
+}
+
+// 全キーを離した状態のレポートを返す。
+//
+// 状態を変更しないので、強制終了時等に別の goroutine から呼び出して良い。
+func (keyboard *HIDKeyboard) ZeroReports() []hid.HIDReport {
+	return keyboard.builder.ZeroReports()
+}
+
+// ホストに送信する HID レポートを作成する。
+//
+// キーボードのレポートは常に返す。
+// それ以外のレポートは、前回から変化があった場合だけ返す。
+// Consumer Control, System Control のレポートは 1 つの usage しか送れないので、
+// 最後に押された usage を送信する。
+func (keyboard *HIDKeyboard) SetupReports() []hid.HIDReport {
+	modifier, codes := keyboard.resolveKeys()
+	consumer := keyboard.convConsumer
+	if consumer == 0 {
+		consumer = keyboard.consumerState.Last()
+	}
+	system := keyboard.convSystem
+	if system == 0 {
+		system = byte(keyboard.systemState.Last())
+	}
+	return keyboard.builder.Reports(modifier, codes, consumer, system)
+}
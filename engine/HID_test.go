@@ -0,0 +1,79 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+const rollOver = hid.KEY_ErrorRollOver
+
+// keyboard の現在のキーボードのレポート
+func keyboardPacket(t *testing.T, keyboard *HIDKeyboard) []byte {
+	t.Helper()
+	for _, report := range keyboard.SetupReports() {
+		if report.Kind == hid.ReportKind_Keyboard {
+			return append([]byte{}, report.Data...)
+		}
+	}
+	t.Fatal("no keyboard report")
+	return nil
+}
+
+func checkPacket(t *testing.T, keyboard *HIDKeyboard, modifier byte, keys ...byte) {
+	t.Helper()
+	expected := make([]byte, 8)
+	expected[0] = modifier
+	copy(expected[2:], keys)
+	if packet := keyboardPacket(t, keyboard); !bytes.Equal(packet, expected) {
+		t.Errorf("% x, expected % x", packet, expected)
+	}
+}
+
+func TestPressedOrderFollowsPress(t *testing.T) {
+	keyboard := NewHIDKeyboard()
+	keyboard.PressKey(hid.KEY_C)
+	checkPacket(t, keyboard, 0, hid.KEY_C)
+	keyboard.PressKey(hid.KEY_A)
+	checkPacket(t, keyboard, 0, hid.KEY_C, hid.KEY_A)
+	keyboard.PressKey(hid.KEY_L_Shift)
+	keyboard.PressKey(hid.KEY_B)
+	checkPacket(t, keyboard, 0x02, hid.KEY_C, hid.KEY_A, hid.KEY_B)
+	// キーリピートでは位置を変えない
+	keyboard.PressKey(hid.KEY_C)
+	checkPacket(t, keyboard, 0x02, hid.KEY_C, hid.KEY_A, hid.KEY_B)
+}
+
+func TestPressedOrderReleaseMiddle(t *testing.T) {
+	keyboard := NewHIDKeyboard()
+	for _, code := range []byte{hid.KEY_A, hid.KEY_B, hid.KEY_C, hid.KEY_D} {
+		keyboard.PressKey(code)
+	}
+	keyboard.ReleaseKey(hid.KEY_B)
+	checkPacket(t, keyboard, 0, hid.KEY_A, hid.KEY_C, hid.KEY_D)
+	keyboard.PressKey(hid.KEY_B)
+	checkPacket(t, keyboard, 0, hid.KEY_A, hid.KEY_C, hid.KEY_D, hid.KEY_B)
+}
+
+func TestPressedOrderRollOver(t *testing.T) {
+	keyboard := NewHIDKeyboard()
+	keyboard.PressKey(hid.KEY_L_Shift)
+	for code := byte(hid.KEY_A); code < hid.KEY_A+6; code++ {
+		keyboard.PressKey(code)
+	}
+	checkPacket(t, keyboard, 0x02, hid.KEY_A, hid.KEY_B, hid.KEY_C, hid.KEY_D, hid.KEY_E, hid.KEY_F)
+
+	// 7 キー目で全キーを ErrorRollOver にする。 modifier はそのまま。
+	keyboard.PressKey(hid.KEY_G)
+	checkPacket(t, keyboard, 0x02,
+		rollOver, rollOver, rollOver, rollOver, rollOver, rollOver)
+
+	// 6 キー以下に戻ったら、押された順に戻す
+	keyboard.ReleaseKey(hid.KEY_C)
+	checkPacket(t, keyboard, 0x02, hid.KEY_A, hid.KEY_B, hid.KEY_D, hid.KEY_E, hid.KEY_F, hid.KEY_G)
+	keyboard.ReleaseKey(hid.KEY_A)
+	checkPacket(t, keyboard, 0x02, hid.KEY_B, hid.KEY_D, hid.KEY_E, hid.KEY_F, hid.KEY_G)
+}
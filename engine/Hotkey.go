@@ -0,0 +1,259 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// ホットキーで実行する処理
+type HotkeyAction int
+
+const (
+	HotkeyAction_None HotkeyAction = iota
+	// プログラムを終了する
+	HotkeyAction_Exit
+	// リマップを一時停止・再開する。停止中はホストにキーを送信しない。
+	HotkeyAction_Pause
+	// config を読み込み直す
+	HotkeyAction_Reload
+	// バイパスを切り替える。バイパス中は置き換えずにキーをそのまま送信する。
+	HotkeyAction_Bypass
+)
+
+func (action HotkeyAction) String() string {
+	switch action {
+	case HotkeyAction_None:
+		return "none"
+	case HotkeyAction_Exit:
+		return "exit"
+	case HotkeyAction_Pause:
+		return "pause"
+	case HotkeyAction_Reload:
+		return "reload"
+	case HotkeyAction_Bypass:
+		return "bypass"
+	}
+	return "unknown"
+}
+
+// config の処理名を HotkeyAction に変換する
+func ParseHotkeyAction(txt string) (HotkeyAction, error) {
+	switch txt {
+	case "", "exit":
+		return HotkeyAction_Exit, nil
+	case "pause":
+		return HotkeyAction_Pause, nil
+	case "reload":
+		return HotkeyAction_Reload, nil
+	case "bypass":
+		return HotkeyAction_Bypass, nil
+	}
+	return HotkeyAction_None, fmt.Errorf("unknown hotkey action -- %s", txt)
+}
+
+// 特定のキー操作で処理を実行するキー。
+//
+// Sequence は順に押すキー、 Chord は同時に押すキーで、どちらか一方を指定する。
+type Hotkey struct {
+	Sequence []uint8
+	Chord    []uint8
+	// Chord を押し続ける時間。 0 の場合は揃った時点で実行する。
+	Hold   time.Duration
+	Action HotkeyAction
+
+	// Sequence の KMP の失敗関数
+	failure []int
+	// Sequence の一致した長さ
+	pos int
+	// Sequence に modifier を含むかどうか
+	hasModifier bool
+	// Chord が揃ってから Hold を待っているかどうか
+	chordWaiting bool
+	chordStart   time.Time
+	// Chord で実行済みかどうか。 Chord のキーを離すまで再実行しない。
+	chordFired bool
+}
+
+func NewSequenceHotkey(sequence []uint8, action HotkeyAction) *Hotkey {
+	hotkey := &Hotkey{Sequence: sequence, Action: action}
+	// KMP の失敗関数。
+	// failure[i] は sequence[:i+1] の接頭辞と接尾辞が一致する最長の長さ。
+	hotkey.failure = make([]int, len(sequence))
+	length := 0
+	for index := 1; index < len(sequence); index++ {
+		for length > 0 && sequence[index] != sequence[length] {
+			length = hotkey.failure[length-1]
+		}
+		if sequence[index] == sequence[length] {
+			length++
+		}
+		hotkey.failure[index] = length
+	}
+	for _, code := range sequence {
+		if hid.IsModifierCode(code) {
+			hotkey.hasModifier = true
+		}
+	}
+	return hotkey
+}
+
+func NewChordHotkey(chord []uint8, hold time.Duration, action HotkeyAction) *Hotkey {
+	return &Hotkey{Chord: chord, Hold: hold, Action: action}
+}
+
+func (hotkey *Hotkey) String() string {
+	codes := hotkey.Sequence
+	sep := " "
+	if len(hotkey.Chord) > 0 {
+		codes = hotkey.Chord
+		sep = "+"
+	}
+	names := make([]string, len(codes))
+	for index, code := range codes {
+		names[index] = hid.KeyName(code)
+	}
+	txt := strings.Join(names, sep)
+	if hotkey.Hold > 0 {
+		txt += fmt.Sprintf(" (hold %v)", hotkey.Hold)
+	}
+	return fmt.Sprintf("%s: %v", txt, hotkey.Action)
+}
+
+// Sequence の一致を 1 キー進め、全て一致したら true を返す
+func (hotkey *Hotkey) stepSequence(code uint8) bool {
+	if hid.IsModifierCode(code) && !hotkey.hasModifier {
+		// Shift 等を押しながら入力しても一致させる
+		return false
+	}
+	sequence := hotkey.Sequence
+	for hotkey.pos > 0 && sequence[hotkey.pos] != code {
+		hotkey.pos = hotkey.failure[hotkey.pos-1]
+	}
+	if sequence[hotkey.pos] == code {
+		hotkey.pos++
+	}
+	if hotkey.pos == len(sequence) {
+		hotkey.pos = hotkey.failure[hotkey.pos-1]
+		return true
+	}
+	return false
+}
+
+// ホットキーを検出する
+type HotkeyMatcher struct {
+	hotkeys []*Hotkey
+	pressed map[uint8]bool
+	log     Logger
+}
+
+func NewHotkeyMatcher() *HotkeyMatcher {
+	return &HotkeyMatcher{pressed: map[uint8]bool{}, log: NopLogger{}}
+}
+
+func (matcher *HotkeyMatcher) Add(hotkey *Hotkey) {
+	matcher.hotkeys = append(matcher.hotkeys, hotkey)
+}
+
+func (matcher *HotkeyMatcher) Hotkeys() []*Hotkey {
+	return matcher.hotkeys
+}
+
+// HID キーコード code のイベントを処理し、実行する処理を返す。
+func (matcher *HotkeyMatcher) Process(code uint8, pressed bool, now time.Time) HotkeyAction {
+	action := matcher.Expire(now)
+	if pressed == matcher.pressed[code] {
+		// キーリピート
+		return action
+	}
+	if pressed {
+		matcher.pressed[code] = true
+	} else {
+		delete(matcher.pressed, code)
+	}
+	for _, hotkey := range matcher.hotkeys {
+		var hit bool
+		if len(hotkey.Chord) > 0 {
+			hit = matcher.stepChord(hotkey, code, pressed, now)
+		} else if pressed {
+			hit = hotkey.stepSequence(code)
+		}
+		if hit && action == HotkeyAction_None {
+			matcher.log.Infof("hotkey %v", hotkey)
+			action = hotkey.Action
+		}
+	}
+	return action
+}
+
+// Chord の状態を更新し、 Hold 無しで揃った場合は true を返す
+func (matcher *HotkeyMatcher) stepChord(
+	hotkey *Hotkey, code uint8, pressed bool, now time.Time) bool {
+	if !pressed {
+		if containsCode(hotkey.Chord, code) {
+			hotkey.chordWaiting = false
+			hotkey.chordFired = false
+		}
+		return false
+	}
+	if hotkey.chordWaiting || hotkey.chordFired {
+		return false
+	}
+	for _, chordCode := range hotkey.Chord {
+		if !matcher.pressed[chordCode] {
+			return false
+		}
+	}
+	if hotkey.Hold > 0 {
+		hotkey.chordWaiting = true
+		hotkey.chordStart = now
+		return false
+	}
+	hotkey.chordFired = true
+	return true
+}
+
+// Hold を満たした Chord の処理を返す
+func (matcher *HotkeyMatcher) Expire(now time.Time) HotkeyAction {
+	action := HotkeyAction_None
+	for _, hotkey := range matcher.hotkeys {
+		if hotkey.chordWaiting && !now.Before(hotkey.chordStart.Add(hotkey.Hold)) {
+			hotkey.chordWaiting = false
+			hotkey.chordFired = true
+			if action == HotkeyAction_None {
+				matcher.log.Infof("hotkey %v", hotkey)
+				action = hotkey.Action
+			}
+		}
+	}
+	return action
+}
+
+func (matcher *HotkeyMatcher) Deadline() (time.Time, bool) {
+	var earliest time.Time
+	found := false
+	for _, hotkey := range matcher.hotkeys {
+		if !hotkey.chordWaiting {
+			continue
+		}
+		deadline := hotkey.chordStart.Add(hotkey.Hold)
+		if !found || deadline.Before(earliest) {
+			earliest = deadline
+			found = true
+		}
+	}
+	return earliest, found
+}
+
+func (matcher *HotkeyMatcher) Reset() {
+	matcher.pressed = map[uint8]bool{}
+	for _, hotkey := range matcher.hotkeys {
+		hotkey.pos = 0
+		hotkey.chordWaiting = false
+		hotkey.chordFired = false
+	}
+}
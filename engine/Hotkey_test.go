@@ -0,0 +1,196 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// inputs を matcher に通し、実行する処理を "時刻(ms) 処理" の列で返す。
+// expireAt は inputs の後に Expire を呼ぶ時刻 (ms)。
+func matchHotkeys(matcher *HotkeyMatcher, inputs []simInput, expireAt ...int) []string {
+	start := time.Unix(0, 0)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	actions := []string{}
+	add := func(ms int, action HotkeyAction) {
+		if action != HotkeyAction_None {
+			actions = append(actions, fmt.Sprintf("%d %v", ms, action))
+		}
+	}
+	for _, input := range inputs {
+		add(input.at, matcher.Process(input.code, input.pressed, at(input.at)))
+	}
+	for _, ms := range expireAt {
+		add(ms, matcher.Expire(at(ms)))
+	}
+	return actions
+}
+
+// codes を 10ms 間隔で順にタップする
+func tapSequence(codes ...uint8) []simInput {
+	inputs := []simInput{}
+	for index, code := range codes {
+		inputs = append(inputs, down(index*10, code), up(index*10+5, code))
+	}
+	return inputs
+}
+
+func TestHotkeySequence(t *testing.T) {
+	cases := []struct {
+		name     string
+		sequence []uint8
+		inputs   []simInput
+		expected []string
+	}{
+		{
+			"match", []uint8{hid.KEY_A, hid.KEY_B},
+			tapSequence(hid.KEY_X, hid.KEY_A, hid.KEY_B),
+			[]string{"20 exit"},
+		},
+		{
+			"interrupted", []uint8{hid.KEY_A, hid.KEY_B},
+			tapSequence(hid.KEY_A, hid.KEY_X, hid.KEY_B),
+			[]string{},
+		},
+		{
+			// 一致しなかったキーから一致をやり直す
+			"overlapping prefix", []uint8{hid.KEY_A, hid.KEY_A, hid.KEY_B},
+			tapSequence(hid.KEY_A, hid.KEY_A, hid.KEY_A, hid.KEY_B),
+			[]string{"30 exit"},
+		},
+		{
+			"overlapping longer prefix",
+			[]uint8{hid.KEY_A, hid.KEY_B, hid.KEY_A, hid.KEY_B, hid.KEY_C},
+			tapSequence(
+				hid.KEY_A, hid.KEY_B, hid.KEY_A, hid.KEY_B, hid.KEY_A, hid.KEY_B, hid.KEY_C),
+			[]string{"60 exit"},
+		},
+		{
+			// 一致した後も、接尾辞を次の一致に使う
+			"overlapping matches", []uint8{hid.KEY_A, hid.KEY_B, hid.KEY_A},
+			tapSequence(hid.KEY_A, hid.KEY_B, hid.KEY_A, hid.KEY_B, hid.KEY_A),
+			[]string{"20 exit", "40 exit"},
+		},
+		{
+			// Shift を押しながら入力しても一致させる
+			"modifier ignored", []uint8{hid.KEY_A, hid.KEY_B},
+			[]simInput{
+				down(0, hid.KEY_A), up(5, hid.KEY_A), down(10, hid.KEY_L_Shift),
+				down(20, hid.KEY_B), up(25, hid.KEY_B), up(30, hid.KEY_L_Shift)},
+			[]string{"20 exit"},
+		},
+		{
+			"modifier in sequence", []uint8{hid.KEY_L_Shift, hid.KEY_L_Shift},
+			tapSequence(hid.KEY_L_Shift, hid.KEY_L_Shift),
+			[]string{"10 exit"},
+		},
+		{
+			// キーリピートは 1 回の入力にする
+			"key repeat", []uint8{hid.KEY_A, hid.KEY_A},
+			[]simInput{
+				down(0, hid.KEY_A), down(10, hid.KEY_A), up(20, hid.KEY_A), down(30, hid.KEY_A)},
+			[]string{"30 exit"},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			matcher := NewHotkeyMatcher()
+			matcher.Add(NewSequenceHotkey(testCase.sequence, HotkeyAction_Exit))
+			actions := matchHotkeys(matcher, testCase.inputs)
+			if !reflect.DeepEqual(actions, testCase.expected) {
+				t.Errorf("%q, expected %q", actions, testCase.expected)
+			}
+		})
+	}
+}
+
+func TestHotkeyChord(t *testing.T) {
+	chord := []uint8{hid.KEY_L_Control, hid.KEY_Pause}
+	cases := []struct {
+		name     string
+		hold     time.Duration
+		inputs   []simInput
+		expireAt []int
+		expected []string
+	}{
+		{
+			// 揃った時点で 1 回だけ実行し、離して押し直すと再実行する
+			"chord", 0,
+			[]simInput{
+				down(0, hid.KEY_L_Control), down(10, hid.KEY_Pause), down(20, hid.KEY_A),
+				up(30, hid.KEY_Pause), down(40, hid.KEY_Pause)},
+			nil,
+			[]string{"10 pause", "40 pause"},
+		},
+		{
+			"hold", time.Second,
+			[]simInput{down(0, hid.KEY_L_Control), down(10, hid.KEY_Pause)},
+			[]int{1000, 1010, 2000},
+			[]string{"1010 pause"},
+		},
+		{
+			// Hold を満たす前に離すと実行しない
+			"released before hold", time.Second,
+			[]simInput{
+				down(0, hid.KEY_L_Control), down(10, hid.KEY_Pause), up(500, hid.KEY_Pause)},
+			[]int{1010},
+			[]string{},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			matcher := NewHotkeyMatcher()
+			matcher.Add(NewChordHotkey(chord, testCase.hold, HotkeyAction_Pause))
+			actions := matchHotkeys(matcher, testCase.inputs, testCase.expireAt...)
+			if !reflect.DeepEqual(actions, testCase.expected) {
+				t.Errorf("%q, expected %q", actions, testCase.expected)
+			}
+		})
+	}
+}
+
+func TestHotkeyDeadline(t *testing.T) {
+	matcher := NewHotkeyMatcher()
+	matcher.Add(NewChordHotkey(
+		[]uint8{hid.KEY_L_Control, hid.KEY_Pause}, time.Second, HotkeyAction_Pause))
+	if _, has := matcher.Deadline(); has {
+		t.Error("deadline before chord")
+	}
+	start := time.Unix(0, 0)
+	matcher.Process(hid.KEY_L_Control, true, start)
+	matcher.Process(hid.KEY_Pause, true, start)
+	if deadline, has := matcher.Deadline(); !has || !deadline.Equal(start.Add(time.Second)) {
+		t.Errorf("deadline %v %v", deadline, has)
+	}
+	matcher.Reset()
+	if _, has := matcher.Deadline(); has {
+		t.Error("deadline after reset")
+	}
+}
+
+func TestParseHotkeyAction(t *testing.T) {
+	cases := []struct {
+		txt      string
+		expected HotkeyAction
+	}{
+		{"", HotkeyAction_Exit},
+		{"exit", HotkeyAction_Exit},
+		{"pause", HotkeyAction_Pause},
+		{"reload", HotkeyAction_Reload},
+		{"bypass", HotkeyAction_Bypass},
+		{"quit", HotkeyAction_None},
+	}
+	for _, testCase := range cases {
+		action, err := ParseHotkeyAction(testCase.txt)
+		if action != testCase.expected || (err == nil) != (testCase.expected != HotkeyAction_None) {
+			t.Errorf("%q: %v %v", testCase.txt, action, err)
+		}
+	}
+}
@@ -1,9 +1,13 @@
-package main
+package engine
+
+import "time"
 
 type KeyEvent struct {
 	Code    uint8
 	Pressed bool
 	Name    string
+	// イベントの発生時刻。ゼロ値の場合は処理した時刻とする。
+	Time time.Time
 }
 
 func (event *KeyEvent) KeyString() string {
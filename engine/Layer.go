@@ -0,0 +1,184 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import "fmt"
+
+// レイヤーの有効化方法
+type LayerMode int
+
+const (
+	// キーを押している間だけ有効
+	LayerMode_Momentary LayerMode = iota
+	// キーを押す毎に有効・無効を切り替える
+	LayerMode_Toggle
+	// 他のレイヤーを無効にして、このレイヤーだけを有効にする。
+	// レイヤー名が空の場合は、全レイヤーを無効にする。
+	LayerMode_Lock
+)
+
+func (mode LayerMode) String() string {
+	switch mode {
+	case LayerMode_Momentary:
+		return "momentary"
+	case LayerMode_Toggle:
+		return "toggle"
+	case LayerMode_Lock:
+		return "lock"
+	}
+	return "unknown"
+}
+
+// config のレイヤーの有効化方法名を LayerMode に変換する
+func ParseLayerMode(txt string) (LayerMode, error) {
+	switch txt {
+	case "", "momentary":
+		return LayerMode_Momentary, nil
+	case "toggle":
+		return LayerMode_Toggle, nil
+	case "lock":
+		return LayerMode_Lock, nil
+	}
+	return LayerMode_Momentary, fmt.Errorf("unknown layer mode -- %s", txt)
+}
+
+// キーの置き換えを切り替えるレイヤー
+type Layer struct {
+	Name string
+	// HID キーコード → このレイヤーの ConvKeyInfo
+	convKeyMap map[uint8][]*ConvKeyInfo
+	// momentary で押されているキーの数
+	momentary int
+	// toggle, lock で有効になっているかどうか
+	toggled bool
+}
+
+func (layer *Layer) AddConvKey(code byte, convKey *ConvKeyInfo) {
+	layer.convKeyMap[code] = append(layer.convKeyMap[code], convKey)
+}
+
+// レイヤーが有効かどうか
+func (layer *Layer) IsActive() bool {
+	return layer.momentary > 0 || layer.toggled
+}
+
+// レイヤーを操作するキー
+type layerKey struct {
+	// 操作対象のレイヤー。 lock で全レイヤーを無効にする場合は nil。
+	layer *Layer
+	mode  LayerMode
+}
+
+// name のレイヤーを返す。無い場合は作成する。
+//
+// 後から追加したレイヤーほど優先度が高い。
+func (keyboard *HIDKeyboard) AddLayer(name string) *Layer {
+	if layer := keyboard.GetLayer(name); layer != nil {
+		return layer
+	}
+	layer := &Layer{Name: name, convKeyMap: map[uint8][]*ConvKeyInfo{}}
+	keyboard.layers = append(keyboard.layers, layer)
+	return layer
+}
+
+// name のレイヤーを返す。無い場合は nil。
+func (keyboard *HIDKeyboard) GetLayer(name string) *Layer {
+	for _, layer := range keyboard.layers {
+		if layer.Name == name {
+			return layer
+		}
+	}
+	return nil
+}
+
+// HID キーコード code のキーを、 layerName のレイヤーを操作するキーにする。
+func (keyboard *HIDKeyboard) AddLayerKey(code byte, layerName string, mode LayerMode) error {
+	layer := keyboard.GetLayer(layerName)
+	if layer == nil && !(mode == LayerMode_Lock && layerName == "") {
+		return fmt.Errorf("unknown layer -- %s", layerName)
+	}
+	keyboard.layerKeys[code] = &layerKey{layer, mode}
+	return nil
+}
+
+// code がレイヤーを操作するキーの場合、レイヤーの状態を更新して true を返す。
+//
+// レイヤーを操作するキーはホストに送信しない。
+// バイパス中は、レイヤーを操作するキーも通常のキーとして扱う。
+func (keyboard *HIDKeyboard) ProcessLayerKey(code byte, pressed bool) bool {
+	if keyboard.bypass {
+		return false
+	}
+	key, has := keyboard.layerKeys[code]
+	if !has {
+		return false
+	}
+	if pressed == keyboard.pressedLayerKeys[code] {
+		// キーリピート
+		return true
+	}
+	keyboard.pressedLayerKeys[code] = pressed
+	keyboard.ApplyLayerAction(key.layer, key.mode, pressed)
+	return true
+}
+
+// layer に mode の操作をする。
+//
+// pressed は操作するキーを押したか離したか。
+func (keyboard *HIDKeyboard) ApplyLayerAction(layer *Layer, mode LayerMode, pressed bool) {
+	switch mode {
+	case LayerMode_Momentary:
+		if layer == nil {
+			return
+		}
+		if pressed {
+			layer.momentary++
+		} else if layer.momentary > 0 {
+			layer.momentary--
+		}
+	case LayerMode_Toggle:
+		if layer == nil || !pressed {
+			return
+		}
+		layer.toggled = !layer.toggled
+	case LayerMode_Lock:
+		if !pressed {
+			return
+		}
+		for _, other := range keyboard.layers {
+			other.toggled = false
+		}
+		if layer != nil {
+			layer.toggled = true
+		}
+	}
+	if layer != nil {
+		keyboard.log.Infof("layer %s: %v %v -> active %v", layer.Name, mode, pressed, layer.IsActive())
+	} else {
+		keyboard.log.Infof("layer: %v %v -> base", mode, pressed)
+	}
+}
+
+// code のキーが押された時に使用する、レイヤーの ConvKeyInfo のリストを返す。
+//
+// 有効なレイヤーのうち、 code の置き換えを持つ最も優先度の高いレイヤーのものを返す。
+func (keyboard *HIDKeyboard) resolveLayerConvKey(code byte) []*ConvKeyInfo {
+	for index := len(keyboard.layers) - 1; index >= 0; index-- {
+		layer := keyboard.layers[index]
+		if !layer.IsActive() {
+			continue
+		}
+		if convKeyList, has := layer.convKeyMap[code]; has {
+			return convKeyList
+		}
+	}
+	return nil
+}
+
+// 全レイヤーの momentary の状態をクリアする
+func (keyboard *HIDKeyboard) releaseMomentaryLayers() {
+	for _, layer := range keyboard.layers {
+		layer.momentary = 0
+	}
+	keyboard.pressedLayerKeys = map[uint8]bool{}
+}
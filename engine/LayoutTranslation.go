@@ -0,0 +1,64 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"sort"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// 物理キーボードのレイアウト physical で入力した文字が、
+// ホストのレイアウト host でも同じ文字になるように置き換える ConvKeyInfo を返す。
+//
+// キーと Shift の状態をまとめて置き換える。
+// 例えば JIS → US の場合、 Shift+2 (") は Shift+' に、 @ のキーは Shift+2 になる。
+// host で入力できない文字のキー (US の ¥ 等) は置き換えない。
+func NewLayoutTranslation(physical, host *TextLayout) map[uint8][]*ConvKeyInfo {
+	strokes := []KeyStroke{}
+	for stroke := range physical.chars {
+		if stroke.Modifier == 0 || stroke.Modifier == MOD_L_Shift {
+			strokes = append(strokes, stroke)
+		}
+	}
+	sort.Slice(strokes, func(i, j int) bool {
+		if strokes[i].Code != strokes[j].Code {
+			return strokes[i].Code < strokes[j].Code
+		}
+		return strokes[i].Modifier < strokes[j].Modifier
+	})
+
+	convKeyMap := map[uint8][]*ConvKeyInfo{}
+	for _, stroke := range strokes {
+		hostStroke, has := host.KeyStroke(physical.chars[stroke])
+		if !has || hostStroke == stroke {
+			continue
+		}
+		hostShift := hostStroke.Modifier & MOD_L_Shift
+		otherModifier := hostStroke.Modifier &^ MOD_L_Shift
+		if stroke.Modifier == 0 {
+			convKeyMap[stroke.Code] = append(convKeyMap[stroke.Code], &ConvKeyInfo{
+				CondModifierMask:   hid.ModifierBits(hid.LR_SHIFTBIT),
+				CondModifierResult: 0,
+				Code:               hid.HIDCode(hostStroke.Code),
+				ModifierXor:        hid.ModifierBits(hostStroke.Modifier),
+			})
+			continue
+		}
+		// 左右どちらの Shift でも良いので、 Shift の押し方毎に置き換えを作る
+		for _, shift := range []byte{hid.L_SHIFTBIT, hid.LR_SHIFTBIT &^ hid.L_SHIFTBIT, hid.LR_SHIFTBIT} {
+			xor := otherModifier
+			if hostShift == 0 {
+				// Shift を離した状態にする
+				xor |= shift
+			}
+			convKeyMap[stroke.Code] = append(convKeyMap[stroke.Code], &ConvKeyInfo{
+				CondModifierMask:   hid.ModifierBits(hid.LR_SHIFTBIT),
+				CondModifierResult: hid.ModifierBits(shift),
+				Code:               hid.HIDCode(hostStroke.Code),
+				ModifierXor:        hid.ModifierBits(xor),
+			})
+		}
+	}
+	return convKeyMap
+}
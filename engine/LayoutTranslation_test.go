@@ -0,0 +1,112 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"testing"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+func TestLayoutTranslation(t *testing.T) {
+	tap := func(code uint8) []simInput {
+		return []simInput{down(0, code), up(10, code)}
+	}
+	withShift := func(shift, code uint8) []simInput {
+		return []simInput{down(0, shift), down(10, code), up(20, code), up(30, shift)}
+	}
+	cases := []struct {
+		name     string
+		physical *TextLayout
+		host     *TextLayout
+		inputs   []simInput
+		expected []string
+	}{
+		{
+			"jis @", TextLayout_JIS, TextLayout_US,
+			tap(hid.KEY_L_BRACE),
+			[]string{"0 shift+digit2", "10 -"},
+		},
+		{
+			"jis shift+2", TextLayout_JIS, TextLayout_US,
+			withShift(hid.KEY_L_Shift, hid.KEY_2),
+			[]string{"0 shift", "10 shift+quote", "20 shift", "30 -"},
+		},
+		{
+			// 右 Shift でも同じ置き換えになる
+			"jis rshift+2", TextLayout_JIS, TextLayout_US,
+			withShift(hid.KEY_R_Shift, hid.KEY_2),
+			[]string{"0 rshift", "10 rshift+quote", "20 rshift", "30 -"},
+		},
+		{
+			// US で入力できない ¥ はそのまま
+			"jis yen", TextLayout_JIS, TextLayout_US,
+			tap(hid.KEY_International3),
+			[]string{"0 yen", "10 -"},
+		},
+		{
+			"jis shift+yen", TextLayout_JIS, TextLayout_US,
+			withShift(hid.KEY_L_Shift, hid.KEY_International3),
+			[]string{"0 shift", "10 shift+backslash", "20 shift", "30 -"},
+		},
+		{
+			"jis ro", TextLayout_JIS, TextLayout_US,
+			tap(hid.KEY_International1),
+			[]string{"0 backslash", "10 -"},
+		},
+		{
+			"jis shift+ro", TextLayout_JIS, TextLayout_US,
+			withShift(hid.KEY_R_Shift, hid.KEY_International1),
+			[]string{"0 rshift", "10 rshift+minus", "20 rshift", "30 -"},
+		},
+		{
+			// 置き換え先で不要な Shift は、押したキーの間だけ離す
+			"us shift+2", TextLayout_US, TextLayout_JIS,
+			withShift(hid.KEY_L_Shift, hid.KEY_2),
+			[]string{"0 shift", "10 lbracket", "20 shift", "30 -"},
+		},
+		{
+			"us rshift+2", TextLayout_US, TextLayout_JIS,
+			withShift(hid.KEY_R_Shift, hid.KEY_2),
+			[]string{"0 rshift", "10 lbracket", "20 rshift", "30 -"},
+		},
+		{
+			// 左右両方の Shift を押している場合は両方離す
+			"us both shift+2", TextLayout_US, TextLayout_JIS,
+			[]simInput{
+				down(0, hid.KEY_L_Shift), down(5, hid.KEY_R_Shift), down(10, hid.KEY_2),
+				up(20, hid.KEY_2), up(30, hid.KEY_R_Shift), up(35, hid.KEY_L_Shift)},
+			[]string{
+				"0 shift", "5 shift+rshift", "10 lbracket", "20 shift+rshift", "30 shift", "35 -"},
+		},
+		{
+			"us backslash", TextLayout_US, TextLayout_JIS,
+			tap(hid.KEY_BACKSLASH),
+			[]string{"0 ro", "10 -"},
+		},
+		{
+			"us shift+minus", TextLayout_US, TextLayout_JIS,
+			withShift(hid.KEY_L_Shift, hid.KEY_MINUS),
+			[]string{"0 shift", "10 shift+ro", "20 shift", "30 -"},
+		},
+		{
+			// 同じレイアウトでは置き換えない
+			"same layout", TextLayout_US, TextLayout_US,
+			withShift(hid.KEY_L_Shift, hid.KEY_2),
+			[]string{"0 shift", "10 shift+digit2", "20 shift", "30 -"},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			proc := newTestProcessor()
+			keyboard := proc.GetKeyboard()
+			translation := NewLayoutTranslation(testCase.physical, testCase.host)
+			for code, convKeyList := range translation {
+				for _, convKey := range convKeyList {
+					keyboard.AddConvKey(code, convKey)
+				}
+			}
+			checkStream(t, simulateKeyboard(t, proc, testCase.inputs...), testCase.expected...)
+		})
+	}
+}
@@ -0,0 +1,23 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+// ログの出力先。
+//
+// logrus.Logger 等をそのまま設定できる。
+// 設定しない場合はログを出力しない。
+// input, output パッケージも、それぞれの SetLogger で設定した Logger に出力する。
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// ログを出力しない Logger
+type NopLogger struct{}
+
+func (NopLogger) Debugf(format string, args ...interface{}) {}
+func (NopLogger) Infof(format string, args ...interface{})  {}
+func (NopLogger) Warnf(format string, args ...interface{})  {}
+func (NopLogger) Errorf(format string, args ...interface{}) {}
@@ -0,0 +1,230 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+const DEFAULT_MACRO_INTERVAL = 10 * time.Millisecond
+
+// マクロの操作の種類
+type MacroStepKind int
+
+const (
+	// キーを押す
+	MacroStep_Press MacroStepKind = iota
+	// キーを離す
+	MacroStep_Release
+	// キーを押して離す
+	MacroStep_Tap
+	// 待つ
+	MacroStep_Delay
+	// 文字列を入力する
+	MacroStep_Text
+)
+
+// マクロの 1 操作
+type MacroStep struct {
+	Kind MacroStepKind
+	// Press, Release, Tap の HID コード
+	Code byte
+	// Delay の待ち時間
+	Delay time.Duration
+	// Text の文字列を入力するキー操作
+	Strokes []KeyStroke
+}
+
+// 名前付きのキー操作の列
+type Macro struct {
+	Name  string
+	Steps []MacroStep
+}
+
+// layout で text を入力するマクロを作成する
+func NewTextMacro(name string, layout *TextLayout, text string) (*Macro, error) {
+	strokes, err := layout.KeyStrokes(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Macro{name, []MacroStep{{Kind: MacroStep_Text, Strokes: strokes}}}, nil
+}
+
+// マクロが押しているキーの状態
+type macroState struct {
+	// modifier 以外の押されている HID コード
+	codes []uint8
+	// 押されている modifier
+	modifier byte
+	// true の場合、物理キーの modifier を無視して modifier だけを使う
+	override bool
+}
+
+func (state macroState) clone() macroState {
+	state.codes = append([]uint8{}, state.codes...)
+	return state
+}
+
+func (state *macroState) press(code uint8) {
+	if code >= hid.KEY_L_Control && code <= hid.KEY_R_GUI {
+		state.modifier |= 1 << (code - hid.KEY_L_Control)
+	} else if !containsCode(state.codes, code) {
+		state.codes = append(state.codes, code)
+	}
+}
+
+func (state *macroState) release(code uint8) {
+	if code >= hid.KEY_L_Control && code <= hid.KEY_R_GUI {
+		state.modifier &^= 1 << (code - hid.KEY_L_Control)
+		return
+	}
+	for index, val := range state.codes {
+		if val == code {
+			state.codes = append(state.codes[:index], state.codes[index+1:]...)
+			return
+		}
+	}
+}
+
+// 1 レポート分のマクロの状態
+type macroFrame struct {
+	// 前のレポートからの待ち時間
+	delay time.Duration
+	state macroState
+}
+
+// マクロをレポート毎の状態に展開する。
+//
+// 最後は必ず全キーを離した状態になる。
+func (macro *Macro) frames(interval time.Duration) []macroFrame {
+	frames := []macroFrame{}
+	state := macroState{}
+	delay := time.Duration(0)
+	add := func(next macroState) {
+		frames = append(frames, macroFrame{delay, next.clone()})
+		delay = interval
+	}
+	for _, step := range macro.Steps {
+		switch step.Kind {
+		case MacroStep_Press:
+			state.press(step.Code)
+			add(state)
+		case MacroStep_Release:
+			state.release(step.Code)
+			add(state)
+		case MacroStep_Tap:
+			state.press(step.Code)
+			add(state)
+			state.release(step.Code)
+			add(state)
+		case MacroStep_Delay:
+			delay += step.Delay
+		case MacroStep_Text:
+			for _, stroke := range step.Strokes {
+				add(macroState{[]uint8{stroke.Code}, stroke.Modifier, true})
+				add(macroState{nil, 0, true})
+			}
+			add(state)
+		}
+	}
+	if len(state.codes) > 0 || state.modifier != 0 || len(frames) == 0 {
+		add(macroState{})
+	}
+	return frames
+}
+
+// マクロを再生する。
+//
+// 再生は KeyProcessor の Deadline と Expire で進めるので、
+// 長いマクロの再生中もキーボードからのイベントを処理できる。
+// 再生中に別のマクロを開始した場合は、再生中のマクロの後に再生する。
+type MacroPlayer struct {
+	macros map[string]*Macro
+	// レポート間の間隔
+	Interval time.Duration
+	queue    []macroFrame
+	next     time.Time
+	log      Logger
+}
+
+func NewMacroPlayer(interval time.Duration) *MacroPlayer {
+	if interval <= 0 {
+		interval = DEFAULT_MACRO_INTERVAL
+	}
+	return &MacroPlayer{macros: map[string]*Macro{}, Interval: interval, log: NopLogger{}}
+}
+
+func (player *MacroPlayer) Add(macro *Macro) {
+	player.macros[macro.Name] = macro
+}
+
+func (player *MacroPlayer) Get(name string) *Macro {
+	return player.macros[name]
+}
+
+// name のマクロの再生を開始する
+func (player *MacroPlayer) Start(name string, now time.Time) {
+	macro, has := player.macros[name]
+	if !has {
+		player.log.Warnf("unknown macro -- %s", name)
+		return
+	}
+	player.StartMacro(macro, now)
+}
+
+// macro の再生を開始する。 macro は Add していないものでも良い。
+func (player *MacroPlayer) StartMacro(macro *Macro, now time.Time) {
+	player.log.Debugf("macro %s: start", macro.Name)
+	frames := macro.frames(player.Interval)
+	if len(player.queue) == 0 {
+		player.next = now
+	} else {
+		frames[0].delay += player.Interval
+	}
+	player.queue = append(player.queue, frames...)
+}
+
+// now までに再生するフレームを keyboard に反映し、送信するレポートを返す。
+func (player *MacroPlayer) Expire(now time.Time, keyboard *HIDKeyboard) []hid.HIDReport {
+	reports := []hid.HIDReport{}
+	for len(player.queue) > 0 && !now.Before(player.next) {
+		frame := player.queue[0]
+		player.queue = player.queue[1:]
+		keyboard.setMacroState(frame.state)
+		reports = append(reports, keyboard.SetupReports()...)
+		if len(player.queue) > 0 {
+			// 遅れて呼ばれた場合でも、レポートの間隔は空ける
+			player.next = now.Add(player.queue[0].delay)
+		}
+	}
+	return reports
+}
+
+func (player *MacroPlayer) Deadline() (time.Time, bool) {
+	if len(player.queue) == 0 {
+		return time.Time{}, false
+	}
+	return player.next, true
+}
+
+func (player *MacroPlayer) Reset() {
+	player.queue = nil
+}
+
+// macro を再生して output に送信する。再生が終わるまで戻らない。
+//
+// キーボードの入力を処理しない -mode type 用。
+func (player *MacroPlayer) Play(
+	macro *Macro, keyboard *HIDKeyboard, output func(reports []hid.HIDReport)) {
+	player.StartMacro(macro, time.Now())
+	for {
+		deadline, has := player.Deadline()
+		if !has {
+			return
+		}
+		time.Sleep(time.Until(deadline))
+		output(player.Expire(time.Now(), keyboard))
+	}
+}
@@ -0,0 +1,94 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+func textMacro(t *testing.T, name string, text string) *Macro {
+	t.Helper()
+	macro, err := NewTextMacro(name, TextLayout_US, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return macro
+}
+
+func TestMacro(t *testing.T) {
+	tap := func(code uint8) MacroStep {
+		return MacroStep{Kind: MacroStep_Tap, Code: code}
+	}
+	cases := []struct {
+		name     string
+		macros   map[uint8]*Macro
+		inputs   []simInput
+		expected []string
+	}{
+		{
+			// レポートは MacroInterval 毎に送信する。最後は全キーを離す。
+			"press release delay",
+			map[uint8]*Macro{hid.KEY_F1: {Name: "m", Steps: []MacroStep{
+				{Kind: MacroStep_Press, Code: hid.KEY_L_Shift},
+				tap(hid.KEY_A),
+				{Kind: MacroStep_Delay, Delay: 100 * time.Millisecond},
+				tap(hid.KEY_B),
+			}}},
+			[]simInput{down(0, hid.KEY_F1), up(300, hid.KEY_F1)},
+			[]string{
+				"0 -", "0 shift", "10 shift+a", "20 shift",
+				"130 shift+b", "140 shift", "150 -", "300 -"},
+		},
+		{
+			"text", map[uint8]*Macro{hid.KEY_F1: textMacro(t, "t", "Hi")},
+			[]simInput{down(0, hid.KEY_F1), up(100, hid.KEY_F1)},
+			[]string{"0 -", "0 shift+h", "10 -", "20 i", "30 -", "40 -", "100 -"},
+		},
+		{
+			// 文字列の入力中は、押している modifier を無視する
+			"text with held shift", map[uint8]*Macro{hid.KEY_F1: textMacro(t, "t", "i")},
+			[]simInput{
+				down(0, hid.KEY_L_Shift), down(10, hid.KEY_F1), up(100, hid.KEY_F1),
+				up(110, hid.KEY_L_Shift)},
+			[]string{"0 shift", "10 shift", "10 i", "20 -", "30 shift", "100 shift", "110 -"},
+		},
+		{
+			// 再生中もキーボードの入力を処理する
+			"keys while playing",
+			map[uint8]*Macro{hid.KEY_F1: {Name: "m", Steps: []MacroStep{
+				tap(hid.KEY_A), {Kind: MacroStep_Delay, Delay: 100 * time.Millisecond},
+				tap(hid.KEY_B),
+			}}},
+			[]simInput{
+				down(0, hid.KEY_F1), up(5, hid.KEY_F1), down(50, hid.KEY_X), up(60, hid.KEY_X)},
+			[]string{
+				"0 -", "0 a", "5 a", "10 -", "50 x", "60 -", "120 b", "130 -"},
+		},
+		{
+			// 再生中に開始したマクロは、再生中のマクロの後に再生する
+			"queued",
+			map[uint8]*Macro{
+				hid.KEY_F1: {Name: "a", Steps: []MacroStep{tap(hid.KEY_A)}},
+				hid.KEY_F2: {Name: "b", Steps: []MacroStep{tap(hid.KEY_B)}},
+			},
+			[]simInput{
+				down(0, hid.KEY_F1), up(1, hid.KEY_F1), down(2, hid.KEY_F2), up(3, hid.KEY_F2)},
+			[]string{"0 -", "0 a", "1 a", "2 a", "3 a", "10 -", "20 b", "30 -"},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			proc := newTestProcessor()
+			player := NewMacroPlayer(DEFAULT_MACRO_INTERVAL)
+			for code, macro := range testCase.macros {
+				player.Add(macro)
+				proc.GetKeyboard().AddConvKey(code, &ConvKeyInfo{Macro: macro.Name})
+			}
+			proc.SetMacroPlayer(player)
+			checkStream(t, simulateKeyboard(t, proc, testCase.inputs...), testCase.expected...)
+		})
+	}
+}
@@ -0,0 +1,302 @@
+// -*- coding:utf-8; -*-
+
+// Package engine は、キーイベントを HID レポートに変換するリマップの処理系。
+//
+// グローバルな状態を持たず、ログは設定した Logger にだけ出力する。
+package engine
+
+import (
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// レイヤー操作
+type LayerAction struct {
+	// 操作対象のレイヤー名
+	Name string
+	Mode LayerMode
+}
+
+// KeyProcessor のステージ間を流れるキーイベント
+type PipelineEvent struct {
+	// SwitchKeys で置き換えた後の HID キーコード
+	HidCode uint8
+	Pressed bool
+	Time    time.Time
+	// 元の linux のキーイベント。ステージが生成したイベントの場合は nil。
+	KeyEvent *KeyEvent
+	// nil でない場合は、 HidCode のキーの代わりにレイヤーを操作する。
+	Layer *LayerAction
+}
+
+// event と other が同じキーのイベントかどうか
+func (event *PipelineEvent) sameKey(other *PipelineEvent) bool {
+	if event.Layer != nil || other.Layer != nil {
+		return false
+	}
+	if event.HidCode != 0 || other.HidCode != 0 {
+		return event.HidCode == other.HidCode
+	}
+	return event.KeyEvent != nil && other.KeyEvent != nil &&
+		event.KeyEvent.Code == other.KeyEvent.Code
+}
+
+// キーイベントを時間に依存して加工するステージ。
+//
+// 時刻は全て引数で与えられ、ステージ自身は現在時刻を参照しない。
+type KeyStage interface {
+	// event を処理し、次のステージに渡すイベントを返す。
+	Process(event PipelineEvent) []PipelineEvent
+	// now までに期限を迎えた処理を行ない、次のステージに渡すイベントを返す。
+	Expire(now time.Time) []PipelineEvent
+	// 次に Expire を呼び出す必要がある時刻。無い場合は false。
+	Deadline() (time.Time, bool)
+	// 保持している状態を破棄する
+	Reset()
+}
+
+// linux のキーイベントをステージに通し、 HIDKeyboard に反映する。
+type KeyProcessor struct {
+	conv     *Code2HidCode
+	keyboard *HIDKeyboard
+	stages   []KeyStage
+	player   *MacroPlayer
+	hotkeys  *HotkeyMatcher
+	// true の間は、ホットキー以外の処理をしない
+	paused bool
+	timer  *time.Timer
+	log    Logger
+}
+
+// Logger を設定できるステージ
+type loggerSetter interface {
+	setLogger(log Logger)
+}
+
+func NewKeyProcessor(conv *Code2HidCode, keyboard *HIDKeyboard) *KeyProcessor {
+	return &KeyProcessor{
+		conv: conv, keyboard: keyboard,
+		player: NewMacroPlayer(0), hotkeys: NewHotkeyMatcher(), log: NopLogger{}}
+}
+
+// エンジンのログの出力先を設定する。 nil の場合はログを出力しない。
+//
+// 既に設定されているステージ等にも設定する。
+func (proc *KeyProcessor) SetLogger(log Logger) {
+	if log == nil {
+		log = NopLogger{}
+	}
+	proc.log = log
+	proc.conv.log = log
+	proc.keyboard.log = log
+	proc.player.log = log
+	proc.hotkeys.log = log
+	for _, stage := range proc.stages {
+		if setter, ok := stage.(loggerSetter); ok {
+			setter.setLogger(log)
+		}
+	}
+}
+
+// ホットキーを検出する HotkeyMatcher を設定する
+func (proc *KeyProcessor) SetHotkeyMatcher(hotkeys *HotkeyMatcher) {
+	proc.hotkeys = hotkeys
+	proc.hotkeys.log = proc.log
+}
+
+func (proc *KeyProcessor) GetKeyboard() *HIDKeyboard {
+	return proc.keyboard
+}
+
+// 一時停止を設定し、送信するレポートを返す。
+//
+// 停止する時は、押されたままにならないように全キーをリリースする。
+func (proc *KeyProcessor) SetPaused(paused bool) []hid.HIDReport {
+	if proc.paused == paused {
+		return nil
+	}
+	proc.paused = paused
+	proc.log.Infof("remap paused: %v", paused)
+	if paused {
+		return proc.Reset()
+	}
+	return nil
+}
+
+func (proc *KeyProcessor) IsPaused() bool {
+	return proc.paused
+}
+
+// バイパスを設定し、送信するレポートを返す。
+//
+// バイパス中は SwitchKeys, ConvKeyMap, レイヤー, ステージを使わずに、キーをそのまま送信する。
+// 切り替える時は、置き換え前のキーが押されたままにならないように全キーをリリースする。
+func (proc *KeyProcessor) SetBypass(bypass bool) []hid.HIDReport {
+	if proc.conv.IsBypass() == bypass {
+		return nil
+	}
+	reports := proc.Reset()
+	proc.conv.SetBypass(bypass)
+	proc.keyboard.SetBypass(bypass)
+	proc.log.Infof("remap bypass: %v", bypass)
+	return reports
+}
+
+func (proc *KeyProcessor) IsBypass() bool {
+	return proc.conv.IsBypass()
+}
+
+// マクロを再生する MacroPlayer を設定する
+func (proc *KeyProcessor) SetMacroPlayer(player *MacroPlayer) {
+	proc.player = player
+	proc.player.log = proc.log
+}
+
+func (proc *KeyProcessor) GetMacroPlayer() *MacroPlayer {
+	return proc.player
+}
+
+// name のマクロを返す。無い場合は nil。
+func (proc *KeyProcessor) GetMacro(name string) *Macro {
+	return proc.player.Get(name)
+}
+
+// macro の再生を開始し、直ちに送信するレポートを返す。
+//
+// 以降のレポートは Expire で送信するので、 ScheduleExpire を呼び出すこと。
+func (proc *KeyProcessor) PlayMacro(macro *Macro) ([]hid.HIDReport, HotkeyAction) {
+	now := time.Now()
+	proc.player.StartMacro(macro, now)
+	return proc.Expire(now)
+}
+
+// ステージを追加する。先に追加したステージから順にイベントを処理する。
+func (proc *KeyProcessor) AddStage(stage KeyStage) {
+	if setter, ok := stage.(loggerSetter); ok {
+		setter.setLogger(proc.log)
+	}
+	proc.stages = append(proc.stages, stage)
+}
+
+// keyEvent を処理し、送信するレポートと、実行するホットキーの処理を返す。
+func (proc *KeyProcessor) ProcessKeyEvent(keyEvent KeyEvent) ([]hid.HIDReport, HotkeyAction) {
+	if keyEvent.Time.IsZero() {
+		keyEvent.Time = time.Now()
+	}
+	reports, action := proc.Expire(keyEvent.Time)
+	event := proc.conv.ToPipelineEvent(keyEvent)
+	// ホットキーは一時停止中も検出する。
+	// バイパスの切り替えで変わらないように、 SwitchKeys で置き換える前の物理キーで判定する。
+	if hotkeyAction := proc.hotkeys.Process(
+		proc.conv.GetPhysicalHIDKeyCode(keyEvent.Code),
+		event.Pressed, event.Time); hotkeyAction != HotkeyAction_None {
+		action = hotkeyAction
+	}
+	if proc.paused {
+		return reports, action
+	}
+	index := 0
+	if proc.IsBypass() {
+		index = len(proc.stages)
+	}
+	return append(reports, proc.runStages(index, []PipelineEvent{event})...), action
+}
+
+// now までに期限を迎えたステージの処理を行なう。
+func (proc *KeyProcessor) Expire(now time.Time) ([]hid.HIDReport, HotkeyAction) {
+	action := proc.hotkeys.Expire(now)
+	reports := []hid.HIDReport{}
+	for index, stage := range proc.stages {
+		if deadline, has := stage.Deadline(); !has || now.Before(deadline) {
+			continue
+		}
+		reports = append(reports, proc.runStages(index+1, stage.Expire(now))...)
+	}
+	reports = append(reports, proc.player.Expire(now, proc.keyboard)...)
+	return reports, action
+}
+
+// 全ステージのうち、最も早い Deadline を返す。
+func (proc *KeyProcessor) Deadline() (time.Time, bool) {
+	timers := []interface {
+		Deadline() (time.Time, bool)
+	}{proc.player, proc.hotkeys}
+	for _, stage := range proc.stages {
+		timers = append(timers, stage)
+	}
+	var earliest time.Time
+	found := false
+	for _, timer := range timers {
+		if deadline, has := timer.Deadline(); has {
+			if !found || deadline.Before(earliest) {
+				earliest = deadline
+				found = true
+			}
+		}
+	}
+	return earliest, found
+}
+
+// ステージの状態を破棄して全キーをリリースし、送信するレポートを返す。
+func (proc *KeyProcessor) Reset() []hid.HIDReport {
+	for _, stage := range proc.stages {
+		stage.Reset()
+	}
+	proc.player.Reset()
+	proc.hotkeys.Reset()
+	proc.keyboard.ReleaseAllKeys()
+	return proc.keyboard.SetupReports()
+}
+
+// Deadline に Expire を実行するタイマーを設定する。
+//
+// タイマーの処理は post で実行し、その結果を output に渡す。
+// イベントを処理する毎に呼び出すこと。
+func (proc *KeyProcessor) ScheduleExpire(
+	post func(fn func()), output func(reports []hid.HIDReport, action HotkeyAction)) {
+	proc.StopTimer()
+	deadline, has := proc.Deadline()
+	if !has {
+		return
+	}
+	proc.timer = time.AfterFunc(time.Until(deadline), func() {
+		post(func() {
+			output(proc.Expire(time.Now()))
+			proc.ScheduleExpire(post, output)
+		})
+	})
+}
+
+// ScheduleExpire で設定したタイマーを止める
+func (proc *KeyProcessor) StopTimer() {
+	if proc.timer != nil {
+		proc.timer.Stop()
+		proc.timer = nil
+	}
+}
+
+// index 番目以降のステージで events を処理し、 HIDKeyboard に反映する。
+func (proc *KeyProcessor) runStages(index int, events []PipelineEvent) []hid.HIDReport {
+	for ; index < len(proc.stages); index++ {
+		next := []PipelineEvent{}
+		for _, event := range events {
+			next = append(next, proc.stages[index].Process(event)...)
+		}
+		events = next
+	}
+	reports := []hid.HIDReport{}
+	for _, event := range events {
+		pressed := event.Layer == nil && proc.keyboard.IsPressed(event.HidCode)
+		reports = append(reports, proc.conv.ApplyPipelineEvent(proc.keyboard, event)...)
+		if event.Pressed && event.Layer == nil && !pressed &&
+			proc.keyboard.IsPressed(event.HidCode) {
+			// キーリピートでは再生しない
+			if name := proc.keyboard.GetMacroName(event.HidCode); name != "" {
+				proc.player.Start(name, event.Time)
+				reports = append(reports, proc.player.Expire(event.Time, proc.keyboard)...)
+			}
+		}
+	}
+	return reports
+}
@@ -0,0 +1,30 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+// キーの処理系
+type Remapper struct {
+	Keyboard  *HIDKeyboard
+	Processor *KeyProcessor
+	// ホストのキーボードレイアウト
+	TextLayout *TextLayout
+}
+
+// ホットキーの一覧
+func (remapper *Remapper) Hotkeys() []*Hotkey {
+	return remapper.Processor.hotkeys.Hotkeys()
+}
+
+// 動作中の old の状態を引き継ぐ。
+//
+// レポート形式は gadget の report descriptor に合せる必要があるので、 old のものを使う。
+func (remapper *Remapper) TakeOver(old *Remapper) {
+	if remapper.Keyboard.GetReportMode() != old.Keyboard.GetReportMode() {
+		remapper.Processor.log.Warnf("ReportMode can't be changed by reload. keep %v",
+			old.Keyboard.GetReportMode())
+		remapper.Keyboard.SetReportMode(old.Keyboard.GetReportMode())
+	}
+	remapper.Keyboard.SetLockState(old.Keyboard.GetLockState())
+	remapper.Processor.paused = old.Processor.paused
+	remapper.Processor.SetBypass(old.Processor.IsBypass())
+}
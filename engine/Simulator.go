@@ -0,0 +1,106 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// 1 回の入力で処理するタイマーの上限。
+// マクロのリピート等で期限が無くならない場合に止めるため。
+const SIMULATE_MAX_TIMERS = 10000
+
+// シミュレーションの 1 回の処理の結果
+type SimulateStep struct {
+	// 処理した時刻
+	Time time.Time
+	// 処理したキーイベント。タイマーの処理の場合は nil。
+	KeyEvent *KeyEvent
+	// 送信するレポート
+	Reports []hid.HIDReport
+	// ホットキーの処理
+	Action HotkeyAction
+}
+
+// 実時間のタイマーを使わずに、キーイベントの時刻で KeyProcessor を動かす。
+//
+// デバイス無しで、記録したセッションを設定に通した結果を確認するために使う。
+// ホットキーの pause と bypass は反映し、 exit 以降の入力は無視する。
+// reload は何もしない。
+type Simulator struct {
+	proc *KeyProcessor
+	// 最後に処理した時刻
+	now time.Time
+	// exit のホットキーを処理したかどうか
+	exited bool
+}
+
+// start はシミュレーションの開始時刻。時刻の無いキーイベントは、直前の時刻で処理する。
+func NewSimulator(proc *KeyProcessor, start time.Time) *Simulator {
+	return &Simulator{proc: proc, now: start}
+}
+
+// exit のホットキーを処理したかどうか
+func (sim *Simulator) Exited() bool {
+	return sim.exited
+}
+
+// keyEvent の時刻までに期限を迎えるタイマーを処理してから、 keyEvent を処理する。
+func (sim *Simulator) Feed(keyEvent KeyEvent) []SimulateStep {
+	if sim.exited {
+		return nil
+	}
+	if keyEvent.Time.Before(sim.now) {
+		keyEvent.Time = sim.now
+	}
+	steps := sim.expire(keyEvent.Time)
+	if sim.exited {
+		return steps
+	}
+	sim.now = keyEvent.Time
+	reports, action := sim.proc.ProcessKeyEvent(keyEvent)
+	return append(steps, sim.step(&keyEvent, reports, action))
+}
+
+// 入力の終了後に、残っているタイマーを全て処理する。
+func (sim *Simulator) Finish() []SimulateStep {
+	if sim.exited {
+		return nil
+	}
+	return sim.expire(time.Time{})
+}
+
+// until までに期限を迎えるタイマーを処理する。 until がゼロ値の場合は全て処理する。
+func (sim *Simulator) expire(until time.Time) []SimulateStep {
+	steps := []SimulateStep{}
+	for count := 0; count < SIMULATE_MAX_TIMERS && !sim.exited; count++ {
+		deadline, has := sim.proc.Deadline()
+		if !has || (!until.IsZero() && deadline.After(until)) {
+			break
+		}
+		if deadline.After(sim.now) {
+			sim.now = deadline
+		}
+		reports, action := sim.proc.Expire(sim.now)
+		steps = append(steps, sim.step(nil, reports, action))
+	}
+	return steps
+}
+
+// 処理結果の SimulateStep を作成し、ホットキーの処理を反映する。
+func (sim *Simulator) step(
+	keyEvent *KeyEvent, reports []hid.HIDReport, action HotkeyAction) SimulateStep {
+	switch action {
+	case HotkeyAction_Exit:
+		sim.exited = true
+		sim.proc.StopTimer()
+		reports = append(reports, sim.proc.GetKeyboard().ZeroReports()...)
+	case HotkeyAction_Pause:
+		reports = append(reports, sim.proc.SetPaused(!sim.proc.IsPaused())...)
+	case HotkeyAction_Bypass:
+		reports = append(reports, sim.proc.SetBypass(!sim.proc.IsBypass())...)
+	}
+	return SimulateStep{Time: sim.now, KeyEvent: keyEvent, Reports: reports, Action: action}
+}
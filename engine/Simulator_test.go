@@ -0,0 +1,155 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// テスト用のキー入力。 at はシミュレーション開始からの時間 (ms)、 code は HID キーコード。
+type simInput struct {
+	at      int
+	code    uint8
+	pressed bool
+}
+
+func down(at int, code uint8) simInput {
+	return simInput{at, code, true}
+}
+
+func up(at int, code uint8) simInput {
+	return simInput{at, code, false}
+}
+
+// HID キーコード hidCode になる linux のキーコード
+func linuxCode(t *testing.T, hidCode uint8) uint8 {
+	t.Helper()
+	for code, mapped := range hid.NewLinuxKeyTable().HIDCode {
+		if mapped == hidCode {
+			return code
+		}
+	}
+	t.Fatalf("no linux key for %s", hid.KeyName(hidCode))
+	return 0
+}
+
+func newTestProcessor() *KeyProcessor {
+	return NewKeyProcessor(NewCode2HidCode(), NewHIDKeyboard())
+}
+
+// inputs を Simulator で proc に通し、
+// キーボードのレポートを "時刻(ms) 押されているキー" の列で返す。
+func simulateKeyboard(t *testing.T, proc *KeyProcessor, inputs ...simInput) []string {
+	t.Helper()
+	start := time.Unix(0, 0)
+	sim := NewSimulator(proc, start)
+	stream := []string{}
+	add := func(steps []SimulateStep) {
+		for _, step := range steps {
+			for _, report := range step.Reports {
+				if report.Kind == hid.ReportKind_Keyboard {
+					stream = append(stream, fmt.Sprintf(
+						"%d %s", step.Time.Sub(start).Milliseconds(), report.Describe()))
+				}
+			}
+		}
+	}
+	for _, input := range inputs {
+		add(sim.Feed(KeyEvent{
+			Code:    linuxCode(t, input.code),
+			Pressed: input.pressed,
+			Time:    start.Add(time.Duration(input.at) * time.Millisecond),
+		}))
+	}
+	add(sim.Finish())
+	return stream
+}
+
+func checkStream(t *testing.T, stream []string, expected ...string) {
+	t.Helper()
+	if !reflect.DeepEqual(stream, expected) {
+		t.Errorf("reports:\n%q\nexpected:\n%q", stream, expected)
+	}
+}
+
+func TestSimulatorTapHold(t *testing.T) {
+	proc := newTestProcessor()
+	stage := NewTapHoldStage()
+	stage.Add(&TapHold{
+		Key: hid.KEY_F, Tap: hid.KEY_F, Hold: hid.KEY_L_Control,
+		TappingTerm: DEFAULT_TAPPING_TERM,
+	})
+	proc.AddStage(stage)
+
+	stream := simulateKeyboard(t, proc,
+		// TappingTerm 内に離すとタップ
+		down(0, hid.KEY_F), up(100, hid.KEY_F),
+		// TappingTerm を越えるとホールド。判定はタイマーで行なう。
+		down(300, hid.KEY_F), down(600, hid.KEY_A), up(650, hid.KEY_A), up(700, hid.KEY_F),
+	)
+	checkStream(t, stream,
+		"100 f", "100 -",
+		"500 ctrl", "600 ctrl+a", "650 ctrl", "700 -",
+	)
+}
+
+func TestSimulatorCombo(t *testing.T) {
+	proc := newTestProcessor()
+	stage := NewComboStage(DEFAULT_COMBO_TERM)
+	stage.Add(&Combo{Keys: []uint8{hid.KEY_J, hid.KEY_K}, Code: hid.KEY_ESCAPE})
+	proc.AddStage(stage)
+
+	stream := simulateKeyboard(t, proc,
+		// ComboTerm 内に揃うと組み合わせのキー
+		down(0, hid.KEY_J), down(20, hid.KEY_K), up(100, hid.KEY_J), up(110, hid.KEY_K),
+		// 揃わない場合は、 ComboTerm 後に元のキーを押す
+		down(200, hid.KEY_J), up(300, hid.KEY_J),
+	)
+	checkStream(t, stream,
+		"20 esc", "100 -",
+		"250 j", "300 -",
+	)
+}
+
+func TestSimulatorLayer(t *testing.T) {
+	proc := newTestProcessor()
+	keyboard := proc.GetKeyboard()
+	keyboard.AddLayer("nav").AddConvKey(hid.KEY_H, &ConvKeyInfo{Code: hid.KEY_LeftArrow})
+	if err := keyboard.AddLayerKey(hid.KEY_CapsLock, "nav", LayerMode_Momentary); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := simulateKeyboard(t, proc,
+		down(0, hid.KEY_CapsLock), down(10, hid.KEY_H), up(20, hid.KEY_H),
+		up(30, hid.KEY_CapsLock),
+		// レイヤーを離した後は元のキー
+		down(40, hid.KEY_H), up(50, hid.KEY_H),
+	)
+	checkStream(t, stream,
+		"0 -", "10 left", "20 -", "30 -", "40 h", "50 -",
+	)
+}
+
+func TestSimulatorMacro(t *testing.T) {
+	proc := newTestProcessor()
+	player := NewMacroPlayer(DEFAULT_MACRO_INTERVAL)
+	player.Add(&Macro{Name: "ab", Steps: []MacroStep{
+		{Kind: MacroStep_Tap, Code: hid.KEY_A},
+		{Kind: MacroStep_Tap, Code: hid.KEY_B},
+	}})
+	proc.SetMacroPlayer(player)
+	proc.GetKeyboard().AddConvKey(hid.KEY_F1, &ConvKeyInfo{Macro: "ab"})
+
+	stream := simulateKeyboard(t, proc,
+		down(0, hid.KEY_F1), up(100, hid.KEY_F1),
+	)
+	// マクロのキーは MacroInterval 毎に送信する
+	checkStream(t, stream,
+		"0 -", "0 a", "10 -", "20 b", "30 -", "100 -",
+	)
+}
@@ -0,0 +1,197 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import "time"
+
+const DEFAULT_TAPPING_TERM = 200 * time.Millisecond
+
+// タップとホールドで異なる動作をするキー
+type TapHold struct {
+	// タップ・ホールドにするキーの HID コード
+	Key byte
+	// タップした時に送信する HID コード
+	Tap byte
+	// ホールドした時に押す HID コード。 HoldLayer を指定した場合は使用しない。
+	Hold byte
+	// ホールドしている間 momentary で有効にするレイヤー名
+	HoldLayer string
+	// この時間以上押し続けるとホールドになる
+	TappingTerm time.Duration
+	// タップして離してから、この時間内に再度押した場合は
+	// ホールドにせず、タップのキーを押し続ける。 0 の場合は無効。
+	QuickTapTerm time.Duration
+	// TappingTerm 内でも、他のキーを押して離した場合はホールドにする
+	PermissiveHold bool
+	// TappingTerm 内でも、他のキーを押した時点でホールドにする
+	HoldOnOtherKeyPress bool
+}
+
+func (tapHold *TapHold) tapEvent(pressed bool, at time.Time) PipelineEvent {
+	return PipelineEvent{HidCode: tapHold.Tap, Pressed: pressed, Time: at}
+}
+
+func (tapHold *TapHold) holdEvent(pressed bool, at time.Time) PipelineEvent {
+	if tapHold.HoldLayer != "" {
+		return PipelineEvent{
+			Pressed: pressed, Time: at,
+			Layer: &LayerAction{tapHold.HoldLayer, LayerMode_Momentary},
+		}
+	}
+	return PipelineEvent{HidCode: tapHold.Hold, Pressed: pressed, Time: at}
+}
+
+// 確定したタップ・ホールドの状態
+type tapHoldState int
+
+const (
+	tapHoldState_Tap tapHoldState = iota
+	tapHoldState_Hold
+)
+
+// タップ・ホールドを処理するステージ。
+//
+// タップ・ホールドのキーが押されてからタップかホールドかが確定するまでの間、
+// 他のキーのイベントはバッファし、確定後に順番通りに流す。
+type TapHoldStage struct {
+	bindings map[uint8]*TapHold
+	// 確定待ちのキー。無い場合は nil。
+	pending      *TapHold
+	pendingEvent PipelineEvent
+	// 確定待ちの間に受けたイベント
+	buffer []PipelineEvent
+	// 確定して押されているキー
+	active map[uint8]tapHoldState
+	// タップを離した時刻
+	lastTap map[uint8]time.Time
+	log     Logger
+}
+
+func NewTapHoldStage() *TapHoldStage {
+	return &TapHoldStage{
+		bindings: map[uint8]*TapHold{},
+		active:   map[uint8]tapHoldState{},
+		lastTap:  map[uint8]time.Time{},
+		log:      NopLogger{},
+	}
+}
+
+func (stage *TapHoldStage) Add(tapHold *TapHold) {
+	stage.bindings[tapHold.Key] = tapHold
+}
+
+func (stage *TapHoldStage) setLogger(log Logger) {
+	stage.log = log
+}
+
+func (stage *TapHoldStage) Len() int {
+	return len(stage.bindings)
+}
+
+func (stage *TapHoldStage) Process(event PipelineEvent) []PipelineEvent {
+	// タイマーより先にイベントが届いた場合に備え、期限切れを先に処理する
+	events := stage.Expire(event.Time)
+	if stage.pending != nil {
+		return append(events, stage.processPending(event)...)
+	}
+	tapHold, has := stage.bindings[event.HidCode]
+	if !has || event.Layer != nil {
+		return append(events, event)
+	}
+	code := event.HidCode
+	state, pressed := stage.active[code]
+	if event.Pressed {
+		if pressed {
+			// キーリピート
+			return events
+		}
+		if lastTap, has := stage.lastTap[code]; has &&
+			event.Time.Sub(lastTap) < tapHold.QuickTapTerm {
+			stage.active[code] = tapHoldState_Tap
+			return append(events, tapHold.tapEvent(true, event.Time))
+		}
+		stage.pending = tapHold
+		stage.pendingEvent = event
+		return events
+	}
+	if !pressed {
+		return events
+	}
+	delete(stage.active, code)
+	if state == tapHoldState_Hold {
+		return append(events, tapHold.holdEvent(false, event.Time))
+	}
+	stage.lastTap[code] = event.Time
+	return append(events, tapHold.tapEvent(false, event.Time))
+}
+
+// 確定待ちの間のイベントを処理する
+func (stage *TapHoldStage) processPending(event PipelineEvent) []PipelineEvent {
+	tapHold := stage.pending
+	if event.sameKey(&stage.pendingEvent) {
+		if event.Pressed {
+			// キーリピート
+			return nil
+		}
+		// TappingTerm 内に離したのでタップ
+		stage.log.Debugf("tap-hold 0x%x: tap", tapHold.Key)
+		stage.pending = nil
+		stage.lastTap[tapHold.Key] = event.Time
+		events := []PipelineEvent{tapHold.tapEvent(true, stage.pendingEvent.Time)}
+		events = append(events, stage.flush()...)
+		return append(events, tapHold.tapEvent(false, event.Time))
+	}
+	stage.buffer = append(stage.buffer, event)
+	if event.Pressed && tapHold.HoldOnOtherKeyPress {
+		return stage.decideHold(event.Time)
+	}
+	if !event.Pressed && tapHold.PermissiveHold {
+		for _, buffered := range stage.buffer {
+			if buffered.Pressed && buffered.sameKey(&event) {
+				return stage.decideHold(event.Time)
+			}
+		}
+	}
+	return nil
+}
+
+// 確定待ちのキーをホールドに確定する
+func (stage *TapHoldStage) decideHold(at time.Time) []PipelineEvent {
+	tapHold := stage.pending
+	stage.log.Debugf("tap-hold 0x%x: hold", tapHold.Key)
+	stage.pending = nil
+	stage.active[tapHold.Key] = tapHoldState_Hold
+	return append([]PipelineEvent{tapHold.holdEvent(true, at)}, stage.flush()...)
+}
+
+// バッファしたイベントを処理し直す
+func (stage *TapHoldStage) flush() []PipelineEvent {
+	buffer := stage.buffer
+	stage.buffer = nil
+	events := []PipelineEvent{}
+	for _, event := range buffer {
+		events = append(events, stage.Process(event)...)
+	}
+	return events
+}
+
+func (stage *TapHoldStage) Expire(now time.Time) []PipelineEvent {
+	if deadline, has := stage.Deadline(); has && !now.Before(deadline) {
+		return stage.decideHold(deadline)
+	}
+	return nil
+}
+
+func (stage *TapHoldStage) Deadline() (time.Time, bool) {
+	if stage.pending == nil {
+		return time.Time{}, false
+	}
+	return stage.pendingEvent.Time.Add(stage.pending.TappingTerm), true
+}
+
+func (stage *TapHoldStage) Reset() {
+	stage.pending = nil
+	stage.buffer = nil
+	stage.active = map[uint8]tapHoldState{}
+	stage.lastTap = map[uint8]time.Time{}
+}
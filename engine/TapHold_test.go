@@ -0,0 +1,113 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"testing"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+func TestTapHold(t *testing.T) {
+	// F はタップで f、ホールドで ctrl
+	ctrlF := TapHold{
+		Key: hid.KEY_F, Tap: hid.KEY_F, Hold: hid.KEY_L_Control,
+		TappingTerm: DEFAULT_TAPPING_TERM,
+	}
+	with := func(modify func(tapHold *TapHold)) TapHold {
+		tapHold := ctrlF
+		modify(&tapHold)
+		return tapHold
+	}
+	cases := []struct {
+		name     string
+		tapHold  TapHold
+		inputs   []simInput
+		expected []string
+	}{
+		{
+			"tap", ctrlF,
+			[]simInput{down(0, hid.KEY_F), up(100, hid.KEY_F)},
+			[]string{"100 f", "100 -"},
+		},
+		{
+			// ホールドの判定はタイマーで行なう
+			"hold", ctrlF,
+			[]simInput{
+				down(0, hid.KEY_F), down(300, hid.KEY_A), up(350, hid.KEY_A), up(400, hid.KEY_F)},
+			[]string{"200 ctrl", "300 ctrl+a", "350 ctrl", "400 -"},
+		},
+		{
+			// 確定までの他のキーは、タップの後に順番通りに流す
+			"rolled tap", ctrlF,
+			[]simInput{
+				down(0, hid.KEY_F), down(50, hid.KEY_A), up(100, hid.KEY_F), up(150, hid.KEY_A)},
+			[]string{"100 f", "100 f+a", "100 a", "150 -"},
+		},
+		{
+			"permissive hold", with(func(tapHold *TapHold) { tapHold.PermissiveHold = true }),
+			[]simInput{
+				down(0, hid.KEY_F), down(50, hid.KEY_A), up(100, hid.KEY_A), up(150, hid.KEY_F)},
+			[]string{"100 ctrl", "100 ctrl+a", "100 ctrl", "150 -"},
+		},
+		{
+			// 他のキーを押して離さない場合はタップ
+			"permissive hold without release",
+			with(func(tapHold *TapHold) { tapHold.PermissiveHold = true }),
+			[]simInput{
+				down(0, hid.KEY_F), down(50, hid.KEY_A), up(100, hid.KEY_F), up(150, hid.KEY_A)},
+			[]string{"100 f", "100 f+a", "100 a", "150 -"},
+		},
+		{
+			"hold on other key press",
+			with(func(tapHold *TapHold) { tapHold.HoldOnOtherKeyPress = true }),
+			[]simInput{
+				down(0, hid.KEY_F), down(50, hid.KEY_A), up(60, hid.KEY_A), up(70, hid.KEY_F)},
+			[]string{"50 ctrl", "50 ctrl+a", "60 ctrl", "70 -"},
+		},
+		{
+			// タップ直後に押し直すと、ホールドにせずタップのキーを押し続ける
+			"quick tap",
+			with(func(tapHold *TapHold) { tapHold.QuickTapTerm = DEFAULT_TAPPING_TERM }),
+			[]simInput{
+				down(0, hid.KEY_F), up(50, hid.KEY_F), down(100, hid.KEY_F), up(400, hid.KEY_F)},
+			[]string{"50 f", "50 -", "100 f", "400 -"},
+		},
+		{
+			"no quick tap", ctrlF,
+			[]simInput{
+				down(0, hid.KEY_F), up(50, hid.KEY_F), down(100, hid.KEY_F), up(400, hid.KEY_F)},
+			[]string{"50 f", "50 -", "300 ctrl", "400 -"},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			proc := newTestProcessor()
+			stage := NewTapHoldStage()
+			tapHold := testCase.tapHold
+			stage.Add(&tapHold)
+			proc.AddStage(stage)
+			checkStream(t, simulateKeyboard(t, proc, testCase.inputs...), testCase.expected...)
+		})
+	}
+}
+
+func TestTapHoldLayer(t *testing.T) {
+	proc := newTestProcessor()
+	keyboard := proc.GetKeyboard()
+	keyboard.AddLayer("nav").AddConvKey(hid.KEY_H, &ConvKeyInfo{Code: hid.KEY_LeftArrow})
+	stage := NewTapHoldStage()
+	stage.Add(&TapHold{
+		Key: hid.KEY_D, Tap: hid.KEY_D, HoldLayer: "nav", TappingTerm: DEFAULT_TAPPING_TERM,
+	})
+	proc.AddStage(stage)
+
+	stream := simulateKeyboard(t, proc,
+		// ホールドしている間だけレイヤーを有効にする
+		down(0, hid.KEY_D), down(250, hid.KEY_H), up(260, hid.KEY_H), up(300, hid.KEY_D),
+		down(400, hid.KEY_H), up(410, hid.KEY_H),
+	)
+	checkStream(t, stream,
+		"200 -", "250 left", "260 -", "300 -", "400 h", "410 -",
+	)
+}
@@ -0,0 +1,164 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// HID の modifier の bit
+const (
+	MOD_L_Control = byte(1 << (hid.KEY_L_Control - 0xe0))
+	MOD_L_Shift   = byte(1 << (hid.KEY_L_Shift - 0xe0))
+	MOD_R_Alt     = byte(1 << (hid.KEY_R_Alt - 0xe0))
+)
+
+// 1 文字を入力するキー操作
+type KeyStroke struct {
+	// HID キーコード
+	Code byte
+	// 同時に押す modifier
+	Modifier byte
+}
+
+// ホスト側のキーボードレイアウト。
+//
+// ホストのレイアウトによって、同じ文字を入力するキー操作が異なる。
+type TextLayout struct {
+	Name    string
+	strokes map[rune]KeyStroke
+	// キー操作 → 入力される文字
+	chars map[KeyStroke]rune
+}
+
+// レイアウトのキー
+type layoutKey struct {
+	code byte
+	// 修飾なしで入力される文字。 0 は無し。
+	normal rune
+	// Shift で入力される文字。 0 は無し。
+	shifted rune
+	// AltGr (右 Alt) で入力される文字。 0 は無し。
+	altGr rune
+}
+
+// letters は KEY_A から KEY_Z の位置で入力される小文字。
+func newTextLayout(name string, letters string, keys []layoutKey) *TextLayout {
+	layout := &TextLayout{
+		Name: name, strokes: map[rune]KeyStroke{}, chars: map[KeyStroke]rune{}}
+	for index, char := range letters {
+		code := byte(hid.KEY_A + index)
+		layout.add(char, KeyStroke{code, 0})
+		layout.add(char-'a'+'A', KeyStroke{code, MOD_L_Shift})
+	}
+	layout.add('\n', KeyStroke{hid.KEY_Enter, 0})
+	layout.add('\t', KeyStroke{hid.KEY_Tab, 0})
+	layout.add(' ', KeyStroke{hid.KEY_Spacebar, 0})
+	for _, key := range keys {
+		if key.normal != 0 {
+			layout.add(key.normal, KeyStroke{key.code, 0})
+		}
+		if key.shifted != 0 {
+			layout.add(key.shifted, KeyStroke{key.code, MOD_L_Shift})
+		}
+		if key.altGr != 0 {
+			layout.add(key.altGr, KeyStroke{key.code, MOD_R_Alt})
+		}
+	}
+	return layout
+}
+
+// char を stroke で入力する。
+//
+// 同じ文字を複数のキーで入力できる場合は、後に追加したキーで入力する。
+func (layout *TextLayout) add(char rune, stroke KeyStroke) {
+	layout.strokes[char] = stroke
+	layout.chars[stroke] = char
+}
+
+var TextLayout_US = newTextLayout("us", "abcdefghijklmnopqrstuvwxyz", []layoutKey{
+	{hid.KEY_1, '1', '!', 0}, {hid.KEY_2, '2', '@', 0}, {hid.KEY_3, '3', '#', 0},
+	{hid.KEY_4, '4', '$', 0}, {hid.KEY_5, '5', '%', 0}, {hid.KEY_6, '6', '^', 0},
+	{hid.KEY_7, '7', '&', 0}, {hid.KEY_8, '8', '*', 0}, {hid.KEY_9, '9', '(', 0},
+	{hid.KEY_0, '0', ')', 0},
+	{hid.KEY_MINUS, '-', '_', 0}, {hid.KEY_EQ, '=', '+', 0},
+	{hid.KEY_L_BRACE, '[', '{', 0}, {hid.KEY_R_BRACE, ']', '}', 0},
+	{hid.KEY_BACKSLASH, '\\', '|', 0},
+	{hid.KEY_SEMICOLON, ';', ':', 0}, {hid.KEY_APOSTROPHE, '\'', '"', 0},
+	{hid.KEY_Tilde, '`', '~', 0},
+	{hid.KEY_COMMA, ',', '<', 0}, {hid.KEY_DOT, '.', '>', 0}, {hid.KEY_SLASH, '/', '?', 0},
+})
+
+// 日本語 106/109 キーボード
+var TextLayout_JIS = newTextLayout("jis", "abcdefghijklmnopqrstuvwxyz", []layoutKey{
+	{hid.KEY_1, '1', '!', 0}, {hid.KEY_2, '2', '"', 0}, {hid.KEY_3, '3', '#', 0},
+	{hid.KEY_4, '4', '$', 0}, {hid.KEY_5, '5', '%', 0}, {hid.KEY_6, '6', '&', 0},
+	{hid.KEY_7, '7', '\'', 0}, {hid.KEY_8, '8', '(', 0}, {hid.KEY_9, '9', ')', 0},
+	{hid.KEY_0, '0', 0, 0},
+	{hid.KEY_MINUS, '-', '=', 0}, {hid.KEY_EQ, '^', '~', 0},
+	{hid.KEY_International3, '¥', '|', 0},
+	{hid.KEY_L_BRACE, '@', '`', 0}, {hid.KEY_R_BRACE, '[', '{', 0},
+	// JIS の ] は Non-US # の位置。
+	// linux は ] のキーを \ のキーとして扱うので、 KEY_BACKSLASH も ] にする。
+	{hid.KEY_BACKSLASH, ']', '}', 0}, {hid.KEY_GRAVE, ']', '}', 0},
+	{hid.KEY_SEMICOLON, ';', '+', 0}, {hid.KEY_APOSTROPHE, ':', '*', 0},
+	{hid.KEY_COMMA, ',', '<', 0}, {hid.KEY_DOT, '.', '>', 0}, {hid.KEY_SLASH, '/', '?', 0},
+	{hid.KEY_International1, '\\', '_', 0},
+})
+
+// ドイツ語キーボード (QWERTZ)。デッドキーの文字は入力できない。
+var TextLayout_DE = newTextLayout("de", "abcdefghijklmnopqrstuvwxzy", []layoutKey{
+	{hid.KEY_1, '1', '!', 0}, {hid.KEY_2, '2', '"', '²'}, {hid.KEY_3, '3', '§', '³'},
+	{hid.KEY_4, '4', '$', 0}, {hid.KEY_5, '5', '%', 0}, {hid.KEY_6, '6', '&', 0},
+	{hid.KEY_7, '7', '/', '{'}, {hid.KEY_8, '8', '(', '['}, {hid.KEY_9, '9', ')', ']'},
+	{hid.KEY_0, '0', '=', '}'},
+	{hid.KEY_MINUS, 'ß', '?', '\\'},
+	{hid.KEY_Q, 0, 0, '@'}, {hid.KEY_E, 0, 0, '€'}, {hid.KEY_M, 0, 0, 'µ'},
+	{hid.KEY_L_BRACE, 'ü', 'Ü', 0}, {hid.KEY_R_BRACE, '+', '*', '~'},
+	{hid.KEY_GRAVE, '#', '\'', 0},
+	{hid.KEY_SEMICOLON, 'ö', 'Ö', 0}, {hid.KEY_APOSTROPHE, 'ä', 'Ä', 0},
+	{hid.KEY_Tilde, 0, '°', 0},
+	{hid.KEY_NonUS_BACKSLASH, '<', '>', '|'},
+	{hid.KEY_COMMA, ',', ';', 0}, {hid.KEY_DOT, '.', ':', 0}, {hid.KEY_SLASH, '-', '_', 0},
+})
+
+// stroke で入力される文字を返す
+func (layout *TextLayout) Char(stroke KeyStroke) (rune, bool) {
+	char, has := layout.chars[stroke]
+	return char, has
+}
+
+// 名前のレイアウトを返す。 "" の場合は US。
+func ParseTextLayout(name string) (*TextLayout, error) {
+	switch strings.ToLower(name) {
+	case "", "us":
+		return TextLayout_US, nil
+	case "jis", "jp":
+		return TextLayout_JIS, nil
+	case "de":
+		return TextLayout_DE, nil
+	}
+	return nil, fmt.Errorf("unknown text layout -- %s", name)
+}
+
+// char を入力するキー操作を返す
+func (layout *TextLayout) KeyStroke(char rune) (KeyStroke, bool) {
+	stroke, has := layout.strokes[char]
+	return stroke, has
+}
+
+// text を入力するキー操作を返す。入力できない文字がある場合はエラー。
+func (layout *TextLayout) KeyStrokes(text string) ([]KeyStroke, error) {
+	strokes := make([]KeyStroke, 0, len(text))
+	for _, char := range text {
+		stroke, has := layout.KeyStroke(char)
+		if !has {
+			return nil, fmt.Errorf("%q can't be typed with %s layout", char, layout.Name)
+		}
+		strokes = append(strokes, stroke)
+	}
+	return strokes, nil
+}
@@ -0,0 +1,107 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import (
+	"testing"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+func TestTextLayoutKeyStroke(t *testing.T) {
+	cases := []struct {
+		layout   *TextLayout
+		char     rune
+		expected KeyStroke
+	}{
+		{TextLayout_US, 'a', KeyStroke{hid.KEY_A, 0}},
+		{TextLayout_US, 'A', KeyStroke{hid.KEY_A, MOD_L_Shift}},
+		{TextLayout_US, '1', KeyStroke{hid.KEY_1, 0}},
+		{TextLayout_US, '@', KeyStroke{hid.KEY_2, MOD_L_Shift}},
+		{TextLayout_US, '"', KeyStroke{hid.KEY_APOSTROPHE, MOD_L_Shift}},
+		{TextLayout_US, '\n', KeyStroke{hid.KEY_Enter, 0}},
+		{TextLayout_US, ' ', KeyStroke{hid.KEY_Spacebar, 0}},
+
+		{TextLayout_JIS, '@', KeyStroke{hid.KEY_L_BRACE, 0}},
+		{TextLayout_JIS, '"', KeyStroke{hid.KEY_2, MOD_L_Shift}},
+		{TextLayout_JIS, ':', KeyStroke{hid.KEY_APOSTROPHE, 0}},
+		{TextLayout_JIS, '^', KeyStroke{hid.KEY_EQ, 0}},
+		{TextLayout_JIS, '_', KeyStroke{hid.KEY_International1, MOD_L_Shift}},
+		{TextLayout_JIS, '\\', KeyStroke{hid.KEY_International1, 0}},
+		{TextLayout_JIS, '¥', KeyStroke{hid.KEY_International3, 0}},
+		// 同じ文字のキーが複数ある場合は、後に追加したキー
+		{TextLayout_JIS, ']', KeyStroke{hid.KEY_GRAVE, 0}},
+
+		{TextLayout_DE, 'z', KeyStroke{hid.KEY_Y, 0}},
+		{TextLayout_DE, 'Y', KeyStroke{hid.KEY_Z, MOD_L_Shift}},
+		{TextLayout_DE, 'ß', KeyStroke{hid.KEY_MINUS, 0}},
+		{TextLayout_DE, '@', KeyStroke{hid.KEY_Q, MOD_R_Alt}},
+		{TextLayout_DE, '€', KeyStroke{hid.KEY_E, MOD_R_Alt}},
+		{TextLayout_DE, '|', KeyStroke{hid.KEY_NonUS_BACKSLASH, MOD_R_Alt}},
+		{TextLayout_DE, '-', KeyStroke{hid.KEY_SLASH, 0}},
+	}
+	for _, testCase := range cases {
+		stroke, has := testCase.layout.KeyStroke(testCase.char)
+		if !has || stroke != testCase.expected {
+			t.Errorf("%s %q: %v %v, expected %v",
+				testCase.layout.Name, testCase.char, stroke, has, testCase.expected)
+		}
+	}
+}
+
+// 入力できる全ての文字は、そのキー操作で同じ文字に戻る
+func TestTextLayoutChar(t *testing.T) {
+	for _, layout := range []*TextLayout{TextLayout_US, TextLayout_JIS, TextLayout_DE} {
+		for char, stroke := range layout.strokes {
+			if back, has := layout.Char(stroke); !has || back != char {
+				t.Errorf("%s %q: %v is %q", layout.Name, char, stroke, back)
+			}
+		}
+	}
+}
+
+func TestTextLayoutKeyStrokes(t *testing.T) {
+	cases := []struct {
+		layout *TextLayout
+		text   string
+		ok     bool
+	}{
+		{TextLayout_US, "Hello, World!\n", true},
+		{TextLayout_US, "¥", false},
+		{TextLayout_JIS, "a@b_c¥", true},
+		{TextLayout_JIS, "é", false},
+		{TextLayout_DE, "Größe 10€", true},
+		// デッドキーの文字は入力できない
+		{TextLayout_DE, "^", false},
+	}
+	for _, testCase := range cases {
+		strokes, err := testCase.layout.KeyStrokes(testCase.text)
+		if (err == nil) != testCase.ok {
+			t.Errorf("%s %q: %v", testCase.layout.Name, testCase.text, err)
+			continue
+		}
+		if err == nil && len(strokes) != len([]rune(testCase.text)) {
+			t.Errorf("%s %q: %d strokes", testCase.layout.Name, testCase.text, len(strokes))
+		}
+	}
+}
+
+func TestParseTextLayout(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected *TextLayout
+	}{
+		{"", TextLayout_US},
+		{"us", TextLayout_US},
+		{"JIS", TextLayout_JIS},
+		{"jp", TextLayout_JIS},
+		{"de", TextLayout_DE},
+		{"fr", nil},
+	}
+	for _, testCase := range cases {
+		layout, err := ParseTextLayout(testCase.name)
+		if layout != testCase.expected || (err == nil) != (testCase.expected != nil) {
+			t.Errorf("%q: %v %v", testCase.name, layout, err)
+		}
+	}
+}
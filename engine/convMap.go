@@ -0,0 +1,152 @@
+// -*- coding:utf-8; -*-
+
+package engine
+
+import "github.com/ifritJP/hw-keyboard-remapper/hid"
+
+type Code2HidCode struct {
+	// linux のキーコードと HID の usage の対応表
+	table *hid.LinuxKeyTable
+	// HID の remap コード
+	remapHIDCode map[uint8]uint8
+	// true の場合は remap しない
+	bypass bool
+	log    Logger
+}
+
+func NewCode2HidCode() *Code2HidCode {
+	return &Code2HidCode{
+		table:        hid.NewLinuxKeyTable(),
+		remapHIDCode: map[uint8]uint8{},
+		log:          NopLogger{},
+	}
+}
+
+// HID コードの remap を設定
+func (conv *Code2HidCode) SetHIDRemap(oldCode uint8, newCode uint8) {
+	conv.remapHIDCode[oldCode] = newCode
+}
+
+// バイパスするかどうかを設定する
+func (conv *Code2HidCode) SetBypass(bypass bool) {
+	conv.bypass = bypass
+}
+
+func (conv *Code2HidCode) IsBypass() bool {
+	return conv.bypass
+}
+
+// SwitchKeys で置き換える前の、物理キーの HID キーコードを返す
+func (conv *Code2HidCode) GetPhysicalHIDKeyCode(code uint8) uint8 {
+	return conv.table.HIDCode[code]
+}
+
+func (conv *Code2HidCode) GetHIDKeyCode(code uint8) uint8 {
+	// linux のコードから HID のコードに置き換える
+	hidCode, has := conv.table.HIDCode[code]
+	if !has || conv.bypass {
+		return hidCode
+	}
+	// HID から、 remap 用 HID コードに置き換え
+	convCode, has := conv.remapHIDCode[hidCode]
+	if has {
+		return convCode
+	}
+	return hidCode
+}
+
+// Consumer Page の usage を返す。 Consumer Page のキーでない場合は 0。
+func (conv *Code2HidCode) GetConsumerCode(code uint8) uint16 {
+	return conv.table.Consumer[code]
+}
+
+// System Control の usage を返す。 System Control のキーでない場合は 0。
+func (conv *Code2HidCode) GetSystemCode(code uint8) uint8 {
+	return conv.table.System[code]
+}
+
+// keyEvent を KeyProcessor のステージに渡すイベントに変換する。
+func (conv *Code2HidCode) ToPipelineEvent(keyEvent KeyEvent) PipelineEvent {
+	return PipelineEvent{
+		HidCode:  conv.GetHIDKeyCode(keyEvent.Code),
+		Pressed:  keyEvent.KeyPress(),
+		Time:     keyEvent.Time,
+		KeyEvent: &keyEvent,
+	}
+}
+
+// ステージを通過した event を keyboard に反映し、送信するレポートを返す。
+func (conv *Code2HidCode) ApplyPipelineEvent(
+	keyboard *HIDKeyboard, event PipelineEvent) []hid.HIDReport {
+	if event.Layer != nil {
+		layer := keyboard.GetLayer(event.Layer.Name)
+		if layer == nil && event.Layer.Name != "" {
+			conv.log.Warnf("unknown layer -- %s", event.Layer.Name)
+			return nil
+		}
+		keyboard.ApplyLayerAction(layer, event.Layer.Mode, event.Pressed)
+		return keyboard.SetupReports()
+	}
+
+	// ステージが生成したイベントは、元のキーイベントを持たない
+	keyEvent := KeyEvent{Pressed: event.Pressed, Name: "-"}
+	if event.KeyEvent != nil {
+		keyEvent = *event.KeyEvent
+		keyEvent.Pressed = event.Pressed
+		if consumer := conv.GetConsumerCode(keyEvent.Code); consumer != 0 {
+			// Consumer Page のキーは、キーボードのキーとは別に処理する
+			if keyEvent.KeyPress() {
+				keyboard.PressConsumer(consumer)
+			} else {
+				keyboard.ReleaseConsumer(consumer)
+			}
+			conv.log.Debugf(
+				"[event] %v consumer %d(0x%x) %v -> 0x%x",
+				keyEvent.KeyPress(), keyEvent.Code, keyEvent.Code, keyEvent.KeyString(), consumer)
+			return keyboard.SetupReports()
+		}
+		if system := conv.GetSystemCode(keyEvent.Code); system != 0 {
+			if keyEvent.KeyPress() {
+				keyboard.PressSystem(system)
+			} else {
+				keyboard.ReleaseSystem(system)
+			}
+			conv.log.Debugf(
+				"[event] %v system %d(0x%x) %v -> 0x%x",
+				keyEvent.KeyPress(), keyEvent.Code, keyEvent.Code, keyEvent.KeyString(), system)
+			return keyboard.SetupReports()
+		}
+	}
+
+	hidCode := event.HidCode
+	hidName := hid.KeyName(hidCode)
+	if hidKeyInfo := keyboard.GetKeyInfo(hidCode); hidKeyInfo != nil {
+		hidName = hidKeyInfo.Name
+	}
+
+	if keyboard.ProcessLayerKey(hidCode, keyEvent.KeyPress()) {
+		conv.log.Debugf(
+			"[event] %v layer key %d(0x%x) %v -> %v",
+			keyEvent.KeyPress(), keyEvent.Code, keyEvent.Code, keyEvent.KeyString(), hidName)
+		return keyboard.SetupReports()
+	}
+
+	eventTxt := ""
+	// if the state of key is pressed
+	if keyEvent.KeyPress() {
+		keyboard.PressKey(hidCode)
+		eventTxt = "press"
+	}
+
+	// if the state of key is released
+	if keyEvent.KeyRelease() {
+		keyboard.ReleaseKey(hidCode)
+		eventTxt = "release"
+	}
+
+	conv.log.Debugf(
+		"[event] %s key %d(0x%x) %v -> %v",
+		eventTxt, keyEvent.Code, keyEvent.Code, keyEvent.KeyString(), hidName)
+
+	return keyboard.SetupReports()
+}
@@ -0,0 +1,121 @@
+// -*- coding:utf-8; -*-
+
+// Package eventlog は、キーイベントと HID レポートを JSON Lines で記録する形式。
+package eventlog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// イベントログの種類
+const (
+	// evdev から読み込んだ加工前のイベント
+	EventRecord_Evdev = "evdev"
+	// linux のキーイベント (KeyEvent)
+	EventRecord_Key = "key"
+	// HID レポート
+	EventRecord_Report = "report"
+	// ホットキーの処理
+	EventRecord_Hotkey = "hotkey"
+)
+
+// イベントログの 1 行。 JSON Lines で読み書きする。
+type EventRecord struct {
+	Time time.Time `json:"time"`
+	// EventRecord_Evdev, EventRecord_Key, EventRecord_Report, EventRecord_Hotkey のいずれか
+	Type string `json:"type"`
+
+	// EventRecord_Evdev のデバイスのパスと、 input_event の type, code, value
+	Device string `json:"device,omitempty"`
+	EvType uint16 `json:"evType,omitempty"`
+	EvCode uint16 `json:"evCode,omitempty"`
+	Value  int32  `json:"value,omitempty"`
+
+	// EventRecord_Key の linux のキーコードとキー名
+	Code    uint8  `json:"code,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Pressed bool   `json:"pressed,omitempty"`
+
+	// EventRecord_Report のレポートの種類と、データの 16 進数表記
+	Kind string `json:"kind,omitempty"`
+	Data string `json:"data,omitempty"`
+
+	// EventRecord_Hotkey の処理
+	Action string `json:"action,omitempty"`
+}
+
+func NewEvdevRecord(
+	at time.Time, device string, evType, evCode uint16, value int32) EventRecord {
+	return EventRecord{
+		Time: at, Type: EventRecord_Evdev,
+		Device: device, EvType: evType, EvCode: evCode, Value: value,
+	}
+}
+
+func NewKeyEventRecord(keyEvent engine.KeyEvent) EventRecord {
+	return EventRecord{
+		Time: keyEvent.Time, Type: EventRecord_Key,
+		Code: keyEvent.Code, Name: keyEvent.Name, Pressed: keyEvent.Pressed,
+	}
+}
+
+func NewReportRecord(report hid.HIDReport, now time.Time) EventRecord {
+	return EventRecord{
+		Time: now, Type: EventRecord_Report, Kind: report.Kind.String(), Data: report.Hex(),
+	}
+}
+
+func NewHotkeyRecord(action engine.HotkeyAction, now time.Time) EventRecord {
+	return EventRecord{Time: now, Type: EventRecord_Hotkey, Action: action.String()}
+}
+
+// EventRecord_Key のレコードを KeyEvent に変換する
+func (record *EventRecord) KeyEvent() engine.KeyEvent {
+	name := record.Name
+	if name == "" {
+		name = LinuxKeyName(record.Code)
+	}
+	return engine.KeyEvent{Code: record.Code, Pressed: record.Pressed, Name: name, Time: record.Time}
+}
+
+// linux のキー名 (小文字で KEY_ を除いたもの) → linux のキーコード
+var linuxKeyName2Code = map[string]uint8{}
+
+func init() {
+	for code, name := range evdev.KEY {
+		if code <= 0xff {
+			linuxKeyName2Code[strings.ToLower(strings.TrimPrefix(name, "KEY_"))] = uint8(code)
+		}
+	}
+}
+
+// linux のキー名か数値のキーコードを linux のキーコードに変換する。
+//
+// キー名は "KEY_LEFTCTRL" 等の linux のキー名で、大文字小文字と KEY_ は省略できる。
+func ParseLinuxKeyName(name string) (uint8, error) {
+	txt := strings.TrimSpace(name)
+	if code, err := strconv.ParseUint(txt, 0, 8); err == nil {
+		return uint8(code), nil
+	}
+	txt = strings.TrimPrefix(strings.ToLower(txt), "key_")
+	if code, has := linuxKeyName2Code[txt]; has {
+		return code, nil
+	}
+	return 0, fmt.Errorf("unknown linux key name -- %s", name)
+}
+
+// linux のキーコードのキー名を返す
+func LinuxKeyName(code uint8) string {
+	if name, has := evdev.KEY[int(code)]; has {
+		return name
+	}
+	return "?"
+}
@@ -0,0 +1,58 @@
+// -*- coding:utf-8; -*-
+
+package eventlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// イベントログを 1 行 1 レコードの JSON Lines で書き込む。
+//
+// 任意の goroutine から呼び出せる。
+type Writer struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// path のファイルを作成する。 path が "-" の場合は標準出力に書き込む。
+func OpenWriter(path string) (*Writer, error) {
+	file := os.Stdout
+	if path != "-" {
+		var err error
+		if file, err = os.Create(path); err != nil {
+			return nil, err
+		}
+	}
+	return &Writer{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// record を書き込む。
+//
+// パイプの先で直ぐに読めるように、また強制終了しても残るように、 1 行毎に flush する。
+func (writer *Writer) Write(record EventRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.writer.Write(data)
+	writer.writer.WriteByte('\n')
+	return writer.writer.Flush()
+}
+
+func (writer *Writer) Close() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	err := writer.writer.Flush()
+	if writer.file != os.Stdout {
+		if closeErr := writer.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
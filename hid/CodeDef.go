@@ -1,4 +1,4 @@
-package main
+package hid
 
 const (
 	KEY_RESERVE               = 0x00
@@ -101,6 +101,7 @@ const (
 	KEY_KP_9                  = 0x61
 	KEY_KP_0                  = 0x62
 	KEY_KP_DOT                = 0x63
+	KEY_NonUS_BACKSLASH       = 0x64
 	KEY_Application           = 0x65
 	KEY_Power                 = 0x66
 	KEY_KP_EQ                 = 0x67
@@ -181,3 +182,40 @@ const (
 	KEY_R_Alt                 = 0xE6
 	KEY_R_GUI                 = 0xE7
 )
+
+// Consumer Page (0x0C) の usage
+const (
+	CONSUMER_BrightnessUp   = 0x006F
+	CONSUMER_BrightnessDown = 0x0070
+	CONSUMER_Play           = 0x00B0
+	CONSUMER_Pause          = 0x00B1
+	CONSUMER_Record         = 0x00B2
+	CONSUMER_FastForward    = 0x00B3
+	CONSUMER_Rewind         = 0x00B4
+	CONSUMER_NextTrack      = 0x00B5
+	CONSUMER_PrevTrack      = 0x00B6
+	CONSUMER_Stop           = 0x00B7
+	CONSUMER_Eject          = 0x00B8
+	CONSUMER_PlayPause      = 0x00CD
+	CONSUMER_Mute           = 0x00E2
+	CONSUMER_VolumeUp       = 0x00E9
+	CONSUMER_VolumeDown     = 0x00EA
+	CONSUMER_MediaSelect    = 0x0183
+	CONSUMER_Mail           = 0x018A
+	CONSUMER_Calculator     = 0x0192
+	CONSUMER_MyComputer     = 0x0194
+	CONSUMER_WWW            = 0x0196
+	CONSUMER_WWWSearch      = 0x0221
+	CONSUMER_WWWHome        = 0x0223
+	CONSUMER_WWWBack        = 0x0224
+	CONSUMER_WWWForward     = 0x0225
+	CONSUMER_WWWRefresh     = 0x0227
+	CONSUMER_WWWBookmarks   = 0x022A
+)
+
+// Generic Desktop Page (0x01) の System Control の usage
+const (
+	SYSTEM_PowerDown = 0x81
+	SYSTEM_Sleep     = 0x82
+	SYSTEM_WakeUp    = 0x83
+)
@@ -0,0 +1,62 @@
+// -*- coding:utf-8; -*-
+
+package hid
+
+import "io"
+
+// HID の LED output report。ホストのロック状態を表わす。
+type LedState byte
+
+const (
+	LED_NumLock    = LedState(1 << 0)
+	LED_CapsLock   = LedState(1 << 1)
+	LED_ScrollLock = LedState(1 << 2)
+	LED_Compose    = LedState(1 << 3)
+	LED_Kana       = LedState(1 << 4)
+)
+
+// LedState の bit と linux の LED コードの対応
+var LinuxLeds = []struct {
+	State LedState
+	Code  uint16
+}{
+	{LED_NumLock, 0x00},    // LED_NUML
+	{LED_CapsLock, 0x01},   // LED_CAPSL
+	{LED_ScrollLock, 0x02}, // LED_SCROLLL
+	{LED_Compose, 0x03},    // LED_COMPOSE
+	{LED_Kana, 0x04},       // LED_KANA
+}
+
+func (state LedState) String() string {
+	txt := ""
+	names := []string{"NumLock", "CapsLock", "ScrollLock", "Compose", "Kana"}
+	for index, name := range names {
+		if state&(1<<uint(index)) != 0 {
+			if txt != "" {
+				txt += "|"
+			}
+			txt += name
+		}
+	}
+	if txt == "" {
+		return "none"
+	}
+	return txt
+}
+
+// ホストから送られる LED output report を hidOut から読み込み、 listener に通知する。
+//
+// hidOut の読み込みでエラーになるまで戻らない。
+func ReadLedReports(hidOut io.Reader, listener func(state LedState)) error {
+	buf := make([]byte, 64)
+	for {
+		size, err := hidOut.Read(buf)
+		if err != nil {
+			return err
+		}
+		if size < 1 {
+			continue
+		}
+		listener(LedState(buf[0]))
+	}
+}
@@ -0,0 +1,169 @@
+// -*- coding:utf-8; -*-
+
+// Package hid は、 HID の usage の表、キー名、レポートの型を定義する。
+package hid
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// 拡張 HID デバイス (/dev/hidg1) の report ID
+const (
+	REPORT_ID_Consumer = 0x01
+	REPORT_ID_System   = 0x02
+)
+
+// キーボードのレポート形式
+type ReportMode int
+
+const (
+	// boot protocol 互換の 8 バイトのレポート。同時押しは 6 キーまで。
+	ReportMode_Boot ReportMode = iota
+	// usage 0x00-0xE7 を 1 bit ずつ割り当てた N-key rollover のレポート。
+	// boot protocol のホスト (BIOS/UEFI) では使えない。
+	ReportMode_NKRO
+)
+
+// NKRO のレポートのバイト数 (0xE8 bit)
+const NKRO_REPORT_SIZE = (KEY_R_GUI + 1) / 8
+
+func (mode ReportMode) String() string {
+	switch mode {
+	case ReportMode_Boot:
+		return "boot"
+	case ReportMode_NKRO:
+		return "nkro"
+	}
+	return "unknown"
+}
+
+// config のレポート形式名を ReportMode に変換する
+func ParseReportMode(txt string) (ReportMode, error) {
+	switch txt {
+	case "", "boot":
+		return ReportMode_Boot, nil
+	case "nkro":
+		return ReportMode_NKRO, nil
+	}
+	return ReportMode_Boot, fmt.Errorf("unknown report mode -- %s", txt)
+}
+
+// HID レポートの種類
+type ReportKind int
+
+const (
+	// キーボードのレポート (/dev/hidg0)
+	ReportKind_Keyboard ReportKind = iota
+	// Consumer Control のレポート (/dev/hidg1)
+	ReportKind_Consumer
+	// System Control のレポート (/dev/hidg1)
+	ReportKind_System
+)
+
+func (kind ReportKind) String() string {
+	switch kind {
+	case ReportKind_Keyboard:
+		return "keyboard"
+	case ReportKind_Consumer:
+		return "consumer"
+	case ReportKind_System:
+		return "system"
+	}
+	return "unknown"
+}
+
+// ホストに送信する HID レポート
+type HIDReport struct {
+	Kind ReportKind
+	Data []byte
+}
+
+// キーボードのレポートで押されている HID キーコードを返す。
+// modifier は KEY_L_Control-KEY_R_GUI のキーコードにする。
+//
+// 6 キーを越えた ErrorRollOver のレポートの場合は false を返す。
+func (report *HIDReport) KeyCodes() ([]uint8, bool) {
+	codes := []uint8{}
+	if report.Kind != ReportKind_Keyboard {
+		return codes, true
+	}
+	data := report.Data
+	if len(data) == NKRO_REPORT_SIZE {
+		for code := 0; code < len(data)*8; code++ {
+			if data[code/8]&(1<<uint(code%8)) != 0 {
+				codes = append(codes, uint8(code))
+			}
+		}
+		return codes, true
+	}
+	if len(data) < 2 {
+		return codes, true
+	}
+	for bit := 0; bit < 8; bit++ {
+		if data[0]&(1<<uint(bit)) != 0 {
+			codes = append(codes, uint8(KEY_L_Control+bit))
+		}
+	}
+	for _, code := range data[2:] {
+		if code == KEY_ErrorRollOver {
+			return nil, false
+		}
+		if code != 0 {
+			codes = append(codes, code)
+		}
+	}
+	return codes, true
+}
+
+// Consumer Control, System Control のレポートの usage を返す。押されていない場合は 0。
+func (report *HIDReport) Usage() uint16 {
+	switch report.Kind {
+	case ReportKind_Consumer:
+		if len(report.Data) >= 3 {
+			return uint16(report.Data[1]) | uint16(report.Data[2])<<8
+		}
+	case ReportKind_System:
+		if len(report.Data) >= 2 && report.Data[1] != 0 {
+			return uint16(report.Data[1]) + 0x80
+		}
+	}
+	return 0
+}
+
+// レポートのデータの 16 進数表記
+func (report *HIDReport) Hex() string {
+	return hex.EncodeToString(report.Data)
+}
+
+// レポートの内容を人が読める形式で返す。
+//
+// キーボードは押されているキー名を + で繋ぎ、 Consumer/System Control は usage 名にする。
+// 何も押されていない場合は "-"。
+func (report *HIDReport) Describe() string {
+	switch report.Kind {
+	case ReportKind_Keyboard:
+		codes, ok := report.KeyCodes()
+		if !ok {
+			return "ErrorRollOver"
+		}
+		names := make([]string, 0, len(codes))
+		for _, code := range codes {
+			names = append(names, KeyName(code))
+		}
+		if len(names) == 0 {
+			return "-"
+		}
+		return strings.Join(names, "+")
+	case ReportKind_Consumer:
+		if usage := report.Usage(); usage != 0 {
+			return ConsumerUsageName(usage)
+		}
+	case ReportKind_System:
+		if usage := report.Usage(); usage != 0 {
+			return SystemUsageName(usage)
+		}
+	}
+	return "-"
+}
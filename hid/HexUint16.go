@@ -0,0 +1,34 @@
+// -*- coding:utf-8; -*-
+
+package hid
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// config で "0x046d" 形式の文字列でも指定できる uint16
+type HexUint16 uint16
+
+func (val *HexUint16) UnmarshalJSON(data []byte) error {
+	var txt string
+	if err := json.Unmarshal(data, &txt); err != nil {
+		var num uint16
+		if err := json.Unmarshal(data, &num); err != nil {
+			return err
+		}
+		*val = HexUint16(num)
+		return nil
+	}
+	num, err := strconv.ParseUint(txt, 0, 16)
+	if err != nil {
+		return err
+	}
+	*val = HexUint16(num)
+	return nil
+}
+
+func (val HexUint16) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("0x%04x", uint16(val)))
+}
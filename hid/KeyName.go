@@ -0,0 +1,385 @@
+// -*- coding:utf-8; -*-
+
+package hid
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// キー名 → HID キーコード。キー名は小文字。
+var keyName2HidCode = map[string]uint8{
+	"enter": KEY_Enter, "return": KEY_Enter,
+	"esc": KEY_ESCAPE, "escape": KEY_ESCAPE,
+	"backspace": KEY_Backspace, "bs": KEY_Backspace,
+	"tab": KEY_Tab, "space": KEY_Spacebar,
+	"minus": KEY_MINUS, "equal": KEY_EQ,
+	"lbracket": KEY_L_BRACE, "rbracket": KEY_R_BRACE,
+	"backslash": KEY_BACKSLASH, "nonus_hash": KEY_GRAVE,
+	"semicolon": KEY_SEMICOLON, "quote": KEY_APOSTROPHE,
+	"grave": KEY_Tilde, "comma": KEY_COMMA, "dot": KEY_DOT, "period": KEY_DOT,
+	"slash": KEY_SLASH, "capslock": KEY_CapsLock, "caps": KEY_CapsLock,
+	"printscreen": KEY_PrintScreen, "scrolllock": KEY_ScrollLock, "pause": KEY_Pause,
+	"insert": KEY_Insert, "home": KEY_Home, "pageup": KEY_PageUp,
+	"delete": KEY_Delete, "del": KEY_Delete, "end": KEY_End, "pagedown": KEY_PageDown,
+	"right": KEY_RightArrow, "left": KEY_LeftArrow,
+	"down": KEY_DownArrow, "up": KEY_UpArrow,
+	"numlock": KEY_KP_NumLock, "kp_slash": KEY_KP_SLASH, "kp_asterisk": KEY_KP_ASTERISK,
+	"kp_minus": KEY_KP_MINUS, "kp_plus": KEY_KP_PLUS, "kp_enter": KEY_KP_ENTER,
+	"kp_dot": KEY_KP_DOT, "kp_equal": KEY_KP_EQ, "nonus_backslash": KEY_NonUS_BACKSLASH,
+	"application": KEY_Application, "menu": KEY_Application,
+	"mute": KEY_Mute, "volumeup": KEY_VolumeUp, "volumedown": KEY_VolumeDown,
+	"ro": KEY_International1, "kana": KEY_International2, "yen": KEY_International3,
+	"henkan": KEY_International4, "muhenkan": KEY_International5,
+	"lang1": KEY_LANG1, "lang2": KEY_LANG2,
+	"lctrl": KEY_L_Control, "ctrl": KEY_L_Control,
+	"lshift": KEY_L_Shift, "shift": KEY_L_Shift,
+	"lalt": KEY_L_Alt, "alt": KEY_L_Alt,
+	"lgui": KEY_L_GUI, "gui": KEY_L_GUI, "win": KEY_L_GUI, "super": KEY_L_GUI,
+	"rctrl": KEY_R_Control, "rshift": KEY_R_Shift,
+	"ralt": KEY_R_Alt, "altgr": KEY_R_Alt, "rgui": KEY_R_GUI,
+	"leftctrl": KEY_L_Control, "rightctrl": KEY_R_Control,
+	"leftwin": KEY_L_GUI, "rightwin": KEY_R_GUI,
+}
+
+// CodeDef.go の定数名 → HID キーコード
+var keyConstName2HidCode = map[string]uint8{
+	"KEY_RESERVE":               KEY_RESERVE,
+	"KEY_ErrorRollOver":         KEY_ErrorRollOver,
+	"KEY_POSTFail":              KEY_POSTFail,
+	"KEY_ErrorUndefined":        KEY_ErrorUndefined,
+	"KEY_A":                     KEY_A,
+	"KEY_B":                     KEY_B,
+	"KEY_C":                     KEY_C,
+	"KEY_D":                     KEY_D,
+	"KEY_E":                     KEY_E,
+	"KEY_F":                     KEY_F,
+	"KEY_G":                     KEY_G,
+	"KEY_H":                     KEY_H,
+	"KEY_I":                     KEY_I,
+	"KEY_J":                     KEY_J,
+	"KEY_K":                     KEY_K,
+	"KEY_L":                     KEY_L,
+	"KEY_M":                     KEY_M,
+	"KEY_N":                     KEY_N,
+	"KEY_O":                     KEY_O,
+	"KEY_P":                     KEY_P,
+	"KEY_Q":                     KEY_Q,
+	"KEY_R":                     KEY_R,
+	"KEY_S":                     KEY_S,
+	"KEY_T":                     KEY_T,
+	"KEY_U":                     KEY_U,
+	"KEY_V":                     KEY_V,
+	"KEY_W":                     KEY_W,
+	"KEY_X":                     KEY_X,
+	"KEY_Y":                     KEY_Y,
+	"KEY_Z":                     KEY_Z,
+	"KEY_1":                     KEY_1,
+	"KEY_2":                     KEY_2,
+	"KEY_3":                     KEY_3,
+	"KEY_4":                     KEY_4,
+	"KEY_5":                     KEY_5,
+	"KEY_6":                     KEY_6,
+	"KEY_7":                     KEY_7,
+	"KEY_8":                     KEY_8,
+	"KEY_9":                     KEY_9,
+	"KEY_0":                     KEY_0,
+	"KEY_Enter":                 KEY_Enter,
+	"KEY_ESCAPE":                KEY_ESCAPE,
+	"KEY_Backspace":             KEY_Backspace,
+	"KEY_Tab":                   KEY_Tab,
+	"KEY_Spacebar":              KEY_Spacebar,
+	"KEY_MINUS":                 KEY_MINUS,
+	"KEY_EQ":                    KEY_EQ,
+	"KEY_L_BRACE":               KEY_L_BRACE,
+	"KEY_R_BRACE":               KEY_R_BRACE,
+	"KEY_BACKSLASH":             KEY_BACKSLASH,
+	"KEY_GRAVE":                 KEY_GRAVE,
+	"KEY_SEMICOLON":             KEY_SEMICOLON,
+	"KEY_APOSTROPHE":            KEY_APOSTROPHE,
+	"KEY_Tilde":                 KEY_Tilde,
+	"KEY_COMMA":                 KEY_COMMA,
+	"KEY_DOT":                   KEY_DOT,
+	"KEY_SLASH":                 KEY_SLASH,
+	"KEY_CapsLock":              KEY_CapsLock,
+	"KEY_F1":                    KEY_F1,
+	"KEY_F2":                    KEY_F2,
+	"KEY_F3":                    KEY_F3,
+	"KEY_F4":                    KEY_F4,
+	"KEY_F5":                    KEY_F5,
+	"KEY_F6":                    KEY_F6,
+	"KEY_F7":                    KEY_F7,
+	"KEY_F8":                    KEY_F8,
+	"KEY_F9":                    KEY_F9,
+	"KEY_F10":                   KEY_F10,
+	"KEY_F11":                   KEY_F11,
+	"KEY_F12":                   KEY_F12,
+	"KEY_PrintScreen":           KEY_PrintScreen,
+	"KEY_ScrollLock":            KEY_ScrollLock,
+	"KEY_Pause":                 KEY_Pause,
+	"KEY_Insert":                KEY_Insert,
+	"KEY_Home":                  KEY_Home,
+	"KEY_PageUp":                KEY_PageUp,
+	"KEY_Delete":                KEY_Delete,
+	"KEY_End":                   KEY_End,
+	"KEY_PageDown":              KEY_PageDown,
+	"KEY_RightArrow":            KEY_RightArrow,
+	"KEY_LeftArrow":             KEY_LeftArrow,
+	"KEY_DownArrow":             KEY_DownArrow,
+	"KEY_UpArrow":               KEY_UpArrow,
+	"KEY_KP_NumLock":            KEY_KP_NumLock,
+	"KEY_KP_SLASH":              KEY_KP_SLASH,
+	"KEY_KP_ASTERISK":           KEY_KP_ASTERISK,
+	"KEY_KP_MINUS":              KEY_KP_MINUS,
+	"KEY_KP_PLUS":               KEY_KP_PLUS,
+	"KEY_KP_ENTER":              KEY_KP_ENTER,
+	"KEY_KP_1":                  KEY_KP_1,
+	"KEY_KP_2":                  KEY_KP_2,
+	"KEY_KP_3":                  KEY_KP_3,
+	"KEY_KP_4":                  KEY_KP_4,
+	"KEY_KP_5":                  KEY_KP_5,
+	"KEY_KP_6":                  KEY_KP_6,
+	"KEY_KP_7":                  KEY_KP_7,
+	"KEY_KP_8":                  KEY_KP_8,
+	"KEY_KP_9":                  KEY_KP_9,
+	"KEY_KP_0":                  KEY_KP_0,
+	"KEY_KP_DOT":                KEY_KP_DOT,
+	"KEY_NonUS_BACKSLASH":       KEY_NonUS_BACKSLASH,
+	"KEY_Application":           KEY_Application,
+	"KEY_Power":                 KEY_Power,
+	"KEY_KP_EQ":                 KEY_KP_EQ,
+	"KEY_F13":                   KEY_F13,
+	"KEY_F14":                   KEY_F14,
+	"KEY_F15":                   KEY_F15,
+	"KEY_F16":                   KEY_F16,
+	"KEY_F17":                   KEY_F17,
+	"KEY_F18":                   KEY_F18,
+	"KEY_F19":                   KEY_F19,
+	"KEY_F20":                   KEY_F20,
+	"KEY_F21":                   KEY_F21,
+	"KEY_F22":                   KEY_F22,
+	"KEY_F23":                   KEY_F23,
+	"KEY_F24":                   KEY_F24,
+	"KEY_Execute":               KEY_Execute,
+	"KEY_Help":                  KEY_Help,
+	"KEY_Menu":                  KEY_Menu,
+	"KEY_Select":                KEY_Select,
+	"KEY_Stop":                  KEY_Stop,
+	"KEY_Again":                 KEY_Again,
+	"KEY_Undo":                  KEY_Undo,
+	"KEY_Cut":                   KEY_Cut,
+	"KEY_Copy":                  KEY_Copy,
+	"KEY_Paste":                 KEY_Paste,
+	"KEY_Find":                  KEY_Find,
+	"KEY_Mute":                  KEY_Mute,
+	"KEY_VolumeUp":              KEY_VolumeUp,
+	"KEY_VolumeDown":            KEY_VolumeDown,
+	"KEY_KP_Comma":              KEY_KP_Comma,
+	"KEY_KP_Equal":              KEY_KP_Equal,
+	"KEY_International1":        KEY_International1,
+	"KEY_International2":        KEY_International2,
+	"KEY_International3":        KEY_International3,
+	"KEY_International4":        KEY_International4,
+	"KEY_International5":        KEY_International5,
+	"KEY_International6":        KEY_International6,
+	"KEY_International7":        KEY_International7,
+	"KEY_International8":        KEY_International8,
+	"KEY_International9":        KEY_International9,
+	"KEY_LANG1":                 KEY_LANG1,
+	"KEY_LANG2":                 KEY_LANG2,
+	"KEY_LANG3":                 KEY_LANG3,
+	"KEY_LANG4":                 KEY_LANG4,
+	"KEY_LANG5":                 KEY_LANG5,
+	"KEY_LANG6":                 KEY_LANG6,
+	"KEY_LANG7":                 KEY_LANG7,
+	"KEY_LANG8":                 KEY_LANG8,
+	"KEY_LANG9":                 KEY_LANG9,
+	"KEY_Alternate_Erase":       KEY_Alternate_Erase,
+	"KEY_SysReq":                KEY_SysReq,
+	"KEY_Cancel":                KEY_Cancel,
+	"KEY_Clear":                 KEY_Clear,
+	"KEY_Prior":                 KEY_Prior,
+	"KEY_Return":                KEY_Return,
+	"KEY_Separator":             KEY_Separator,
+	"KEY_Out":                   KEY_Out,
+	"KEY_Oper":                  KEY_Oper,
+	"KEY_ClearAgain":            KEY_ClearAgain,
+	"KEY_CrSel":                 KEY_CrSel,
+	"KEY_ExSel":                 KEY_ExSel,
+	"KEY_KP_00":                 KEY_KP_00,
+	"KEY_KP_000":                KEY_KP_000,
+	"KEY_KP_ThousandsSeparator": KEY_KP_ThousandsSeparator,
+	"KEY_KP_DecimalSeparator":   KEY_KP_DecimalSeparator,
+	"KEY_KP_R_PAREN":            KEY_KP_R_PAREN,
+	"KEY_KP_L_PAREN":            KEY_KP_L_PAREN,
+	"KEY_KP_R_BRACE":            KEY_KP_R_BRACE,
+	"KEY_KP_L_BRACE":            KEY_KP_L_BRACE,
+	"KEY_KP_Tab":                KEY_KP_Tab,
+	"KEY_KP_Backspace":          KEY_KP_Backspace,
+	"KEY_L_Control":             KEY_L_Control,
+	"KEY_L_Shift":               KEY_L_Shift,
+	"KEY_L_Alt":                 KEY_L_Alt,
+	"KEY_L_GUI":                 KEY_L_GUI,
+	"KEY_R_Control":             KEY_R_Control,
+	"KEY_R_Shift":               KEY_R_Shift,
+	"KEY_R_Alt":                 KEY_R_Alt,
+	"KEY_R_GUI":                 KEY_R_GUI,
+}
+
+// 正規化したキー名 → HID キーコード
+var normalizedKeyName2HidCode = map[string]uint8{}
+
+// 正規化した CodeDef.go の定数名 → HID キーコード
+var normalizedKeyConstName2HidCode = map[string]uint8{}
+
+// HID キーコード → 代表のキー名
+var hidCode2KeyName = map[uint8]string{}
+
+func init() {
+	for index := 0; index < 26; index++ {
+		keyName2HidCode[string(rune('a'+index))] = uint8(KEY_A + index)
+	}
+	// 数値は HID キーコードなので、数字のキーは "digit1" か KEY_1 等で指定する。
+	for index := 1; index <= 9; index++ {
+		keyName2HidCode[fmt.Sprintf("digit%d", index)] = uint8(KEY_1 + index - 1)
+		keyName2HidCode[fmt.Sprintf("kp_%d", index)] = uint8(KEY_KP_1 + index - 1)
+	}
+	keyName2HidCode["digit0"] = KEY_0
+	keyName2HidCode["kp_0"] = KEY_KP_0
+	for index := 1; index <= 12; index++ {
+		keyName2HidCode[fmt.Sprintf("f%d", index)] = uint8(KEY_F1 + index - 1)
+	}
+	for index := 13; index <= 24; index++ {
+		keyName2HidCode[fmt.Sprintf("f%d", index)] = uint8(KEY_F13 + index - 13)
+	}
+	for name, code := range keyName2HidCode {
+		setRepresentativeKeyName(hidCode2KeyName, code, name)
+		normalizedKeyName2HidCode[normalizeKeyName(name)] = code
+	}
+	// usage 名 ("Keyboard Caps Lock" → "capslock" 等)
+	for code, usageName := range usageNames {
+		for _, name := range []string{usageName, strings.TrimPrefix(usageName, "Keyboard ")} {
+			name = normalizeKeyName(name)
+			if _, has := normalizedKeyName2HidCode[name]; !has {
+				normalizedKeyName2HidCode[name] = code
+			}
+		}
+	}
+	// 別名が無いキーは定数名を代表にする
+	constNames := map[uint8]string{}
+	for name, code := range keyConstName2HidCode {
+		normalizedKeyConstName2HidCode[normalizeKeyName(name)] = code
+		setRepresentativeKeyName(constNames, code, name)
+	}
+	for code, name := range constNames {
+		if _, has := hidCode2KeyName[code]; !has {
+			hidCode2KeyName[code] = name
+		}
+	}
+}
+
+// 別名がある場合は、短い方を code の代表のキー名にする
+func setRepresentativeKeyName(names map[uint8]string, code uint8, name string) {
+	if current, has := names[code]; !has ||
+		len(name) < len(current) || (len(name) == len(current) && name < current) {
+		names[code] = name
+	}
+}
+
+// 大文字小文字と "_", "-", 空白の違いを無視するため、キー名を正規化する
+func normalizeKeyName(name string) string {
+	return strings.Map(func(char rune) rune {
+		switch char {
+		case '_', '-', ' ':
+			return -1
+		}
+		return char
+	}, strings.ToLower(name))
+}
+
+// キー名か数値の HID キーコードを HID キーコードに変換する。
+//
+// キー名は "capslock", "LeftCtrl", "Henkan", "digit1" 等の別名か、 NewHIDKeyboard の表の名前、
+// あるいは "KEY_A" の様に KEY_ で始まる CodeDef.go の定数名。
+// 大文字小文字と "_", "-", 空白の違いは区別しない。
+// 数値は 10 進数か 0x で始まる 16 進数。
+func ParseKeyName(name string) (uint8, error) {
+	txt := strings.TrimSpace(name)
+	if code, err := strconv.ParseUint(txt, 0, 8); err == nil {
+		return uint8(code), nil
+	}
+	if strings.HasPrefix(strings.ToLower(txt), "key_") {
+		if code, has := normalizedKeyConstName2HidCode[normalizeKeyName(txt)]; has {
+			return code, nil
+		}
+	} else if code, has := normalizedKeyName2HidCode[normalizeKeyName(txt)]; has {
+		return code, nil
+	}
+	return 0, fmt.Errorf("unknown key name -- %s", name)
+}
+
+// "Ctrl|Shift" の様に | で区切った modifier キー名か数値を modifier の bit に変換する。
+//
+// "ctrl", "shift" 等は左側のキー。右側は "rctrl" 等で指定する。
+func ParseModifierBits(txt string) (byte, error) {
+	bits := byte(0)
+	for _, item := range strings.Split(txt, "|") {
+		item = strings.TrimSpace(item)
+		if value, err := strconv.ParseUint(item, 0, 8); err == nil {
+			bits |= byte(value)
+			continue
+		}
+		code, err := ParseKeyName(item)
+		if err != nil || !IsModifierCode(code) {
+			return 0, fmt.Errorf("unknown modifier -- %s", item)
+		}
+		bits |= 1 << (code - KEY_L_Control)
+	}
+	return bits, nil
+}
+
+// config の HID キーコード。数値かキー名の文字列で指定する。
+//
+// ParseKeyName と同じく、文字列の数値も HID キーコードとする。
+type HIDCode uint8
+
+func (code *HIDCode) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return json.Unmarshal(data, (*uint8)(code))
+	}
+	value, err := ParseKeyName(name)
+	if err != nil {
+		return err
+	}
+	*code = HIDCode(value)
+	return nil
+}
+
+// config の modifier の bit。数値か "Ctrl|Shift" の様な文字列で指定する。
+type ModifierBits byte
+
+func (bits *ModifierBits) UnmarshalJSON(data []byte) error {
+	var txt string
+	if err := json.Unmarshal(data, &txt); err != nil {
+		return json.Unmarshal(data, (*byte)(bits))
+	}
+	value, err := ParseModifierBits(txt)
+	if err != nil {
+		return err
+	}
+	*bits = ModifierBits(value)
+	return nil
+}
+
+// HID キーコードのキー名を返す。名前が無い場合は 16 進数。
+//
+// 返すキー名は ParseKeyName で元の HID キーコードに戻せる。
+func KeyName(code uint8) string {
+	if name, has := hidCode2KeyName[code]; has {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", code)
+}
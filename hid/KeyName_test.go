@@ -0,0 +1,75 @@
+// -*- coding:utf-8; -*-
+
+package hid
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseKeyName(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected uint8
+		ok       bool
+	}{
+		{"a", KEY_A, true},
+		{"CapsLock", KEY_CapsLock, true},
+		{"Left-Ctrl", KEY_L_Control, true},
+		{"henkan", KEY_International4, true},
+		{"f13", KEY_F13, true},
+		{"kp_1", KEY_KP_1, true},
+		{"Keyboard Caps Lock", KEY_CapsLock, true},
+		{"KEY_CapsLock", KEY_CapsLock, true},
+		{"key_capslock", KEY_CapsLock, true},
+		// 数字のキーは digit か KEY_ で指定する
+		{"digit5", KEY_5, true},
+		{"Digit 0", KEY_0, true},
+		{"KEY_5", KEY_5, true},
+		// 数値は HID キーコード
+		{"5", 5, true},
+		{" 57 ", 57, true},
+		{"0x39", KEY_CapsLock, true},
+		{"256", 0, false},
+		{"KEY_digit5", 0, false},
+		{"unknown", 0, false},
+	}
+	for _, testCase := range cases {
+		code, err := ParseKeyName(testCase.name)
+		if (err == nil) != testCase.ok || code != testCase.expected {
+			t.Errorf("%q: %#x %v, expected %#x", testCase.name, code, err, testCase.expected)
+		}
+	}
+}
+
+func TestHIDCodeUnmarshalJSON(t *testing.T) {
+	cases := []struct {
+		json     string
+		expected HIDCode
+		ok       bool
+	}{
+		{`57`, KEY_CapsLock, true},
+		{`"57"`, KEY_CapsLock, true},
+		{`"0x39"`, KEY_CapsLock, true},
+		// 文字列の数字も HID キーコード
+		{`"5"`, 5, true},
+		{`"digit5"`, KEY_5, true},
+		{`"KEY_5"`, KEY_5, true},
+		{`"CapsLock"`, KEY_CapsLock, true},
+		{`300`, 0, false},
+		{`"unknown"`, 0, false},
+	}
+	for _, testCase := range cases {
+		var code HIDCode
+		err := json.Unmarshal([]byte(testCase.json), &code)
+		if (err == nil) != testCase.ok || code != testCase.expected {
+			t.Errorf("%s: %#x %v, expected %#x", testCase.json, code, err, testCase.expected)
+		}
+	}
+}
+
+func TestKeyNameDigit(t *testing.T) {
+	if name := KeyName(KEY_5); name != "digit5" {
+		t.Errorf("%s", name)
+	}
+}
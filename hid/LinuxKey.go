@@ -1,31 +1,26 @@
 // -*- coding:utf-8; -*-
 
-package main
+package hid
 
-import "github.com/sirupsen/logrus"
+// uinput で作成する仮想キーボードの名前。
+// evdev の入力には、この名前のデバイスを使わない。
+const UINPUT_DEVICE_NAME = "hw-keyboard-remapper"
 
-type Code2HidCode struct {
+// linux のキーコードと HID の usage の対応表
+type LinuxKeyTable struct {
 	// linux のキーコード → HID のキーコード
-	code2HidCode map[uint8]uint8
-	// HID の remap コード
-	remapHIDCode map[uint8]uint8
-	// 処理を終了させるキーシーケンス
-	exitKeySequence []uint8
-	// 現在の キーシーケンスの位置
-	keySequencePos     int
-	exitKeySequenceTxt string
+	HIDCode map[uint8]uint8
+	// linux のキーコード → Consumer Page の usage
+	Consumer map[uint8]uint16
+	// linux のキーコード → System Control の usage
+	System map[uint8]uint8
 }
 
-func NewCode2HidCode(exitKeySequenceTxt string) *Code2HidCode {
-	code := Code2HidCode{}
-	code.exitKeySequenceTxt = exitKeySequenceTxt
-	code.exitKeySequence = make([]uint8, len(exitKeySequenceTxt))
-	for index, oneChar := range exitKeySequenceTxt {
-		code.exitKeySequence[index] = uint8(oneChar) - uint8('a') + uint8(0x04)
-	}
+// 対応表を作成する。呼び出し毎に新しい表を返すので、変更して良い。
+func NewLinuxKeyTable() *LinuxKeyTable {
+	table := LinuxKeyTable{}
 
-	code.remapHIDCode = map[uint8]uint8{}
-	code.code2HidCode = map[uint8]uint8{
+	table.HIDCode = map[uint8]uint8{
 		1:  0x29, // "ESC"
 		2:  0x1E, // "1"
 		3:  0x1F, // "2"
@@ -111,10 +106,10 @@ func NewCode2HidCode(exitKeySequenceTxt string) *Code2HidCode {
 		83: 0x63, // "keypad DEL_."
 		//	84: , // ""
 		//	85: , // "全角半角"
-		//	86: , // ""
+		86: 0x64, // "102ND" (ISO の < >)
 		87: 0x44, // "F11"
 		88: 0x45, // "F12"
-		//	89: , // ""
+		89: 0x87, // "RO" (JIS の \ _)
 		//	90: , // "カタナカ"
 		//	91: , // "ひらがな"
 		92: 0x8A, // "変換"
@@ -138,75 +133,48 @@ func NewCode2HidCode(exitKeySequenceTxt string) *Code2HidCode {
 		110: 0x49, // "Insert"
 		111: 0x4C, // "Del"
 		//	112: , // "macro"
-		//	113: , // "mute"
-		//	114: , // "volue down"
-		//	115: , // "volue up"
-		//	116: , // "power"
+		//	113: , // "mute" → code2ConsumerCode
+		//	114: , // "volue down" → code2ConsumerCode
+		//	115: , // "volue up" → code2ConsumerCode
+		//	116: , // "power" → code2SystemCode
 		//	117: , // "keypad ="
 		//	118: , // "keypad +-"
 		119: 0x48, // "Pause"
 		124: 0x89, // "YEN"
 		125: 0xE3, // win
 	}
-	return &code
-}
-
-func (conv *Code2HidCode) GetExitKeySequenceTxt() string {
-	return conv.exitKeySequenceTxt
-}
-
-// HID コードの remap を設定
-func (conv *Code2HidCode) SetHIDRemap(oldCode uint8, newCode uint8) {
-	conv.remapHIDCode[oldCode] = newCode
-}
-
-func (conv *Code2HidCode) GetHIDKeyCode(code uint8) uint8 {
-	// linux のコードから HID のコードに置き換える
-	hidCode, has := conv.code2HidCode[code]
-	if !has {
-		return 0
-	}
-	// HID から、 remap 用 HID コードに置き換え
-	convCode, has := conv.remapHIDCode[hidCode]
-	if has {
-		return convCode
+	table.Consumer = map[uint8]uint16{
+		113: CONSUMER_Mute,           // "mute"
+		114: CONSUMER_VolumeDown,     // "volume down"
+		115: CONSUMER_VolumeUp,       // "volume up"
+		140: CONSUMER_Calculator,     // "calc"
+		150: CONSUMER_WWW,            // "www"
+		155: CONSUMER_Mail,           // "mail"
+		156: CONSUMER_WWWBookmarks,   // "bookmarks"
+		157: CONSUMER_MyComputer,     // "computer"
+		158: CONSUMER_WWWBack,        // "back"
+		159: CONSUMER_WWWForward,     // "forward"
+		161: CONSUMER_Eject,          // "eject"
+		163: CONSUMER_NextTrack,      // "next song"
+		164: CONSUMER_PlayPause,      // "play/pause"
+		165: CONSUMER_PrevTrack,      // "previous song"
+		166: CONSUMER_Stop,           // "stop"
+		167: CONSUMER_Record,         // "record"
+		168: CONSUMER_Rewind,         // "rewind"
+		172: CONSUMER_WWWHome,        // "homepage"
+		173: CONSUMER_WWWRefresh,     // "refresh"
+		200: CONSUMER_Play,           // "play"
+		201: CONSUMER_Pause,          // "pause"
+		208: CONSUMER_FastForward,    // "fast forward"
+		217: CONSUMER_WWWSearch,      // "search"
+		224: CONSUMER_BrightnessDown, // "brightness down"
+		225: CONSUMER_BrightnessUp,   // "brightness up"
+		226: CONSUMER_MediaSelect,    // "media"
 	}
-	return hidCode
-}
-
-func (conv *Code2HidCode) ProcessKeyEvent(keyboard *HIDKeyboard, keyEvent KeyEvent) ([]byte, bool, int) {
-	hidCode := conv.GetHIDKeyCode(keyEvent.Code)
-	hidKeyInfo := keyboard.GetKeyInfo(hidCode)
-
-	eventTxt := ""
-	// if the state of key is pressed
-	if keyEvent.KeyPress() {
-		keyboard.PressKey(hidCode)
-		eventTxt = "press"
-
-		// キーシーケンスのチェック
-		if conv.keySequencePos < len(conv.exitKeySequence) {
-			if conv.exitKeySequence[conv.keySequencePos] == hidCode {
-				conv.keySequencePos++
-			} else {
-				if conv.exitKeySequence[0] == hidCode {
-					conv.keySequencePos = 1
-				} else {
-					conv.keySequencePos = 0
-				}
-			}
-		}
+	table.System = map[uint8]uint8{
+		116: SYSTEM_PowerDown, // "power"
+		142: SYSTEM_Sleep,     // "sleep"
+		143: SYSTEM_WakeUp,    // "wakeup"
 	}
-
-	// if the state of key is released
-	if keyEvent.KeyRelease() {
-		keyboard.ReleaseKey(hidCode)
-		eventTxt = "release"
-	}
-
-	logrus.Debugf(
-		"[event] %s key %d(0x%x) %v -> %v",
-		eventTxt, keyEvent.Code, keyEvent.Code, keyEvent.KeyString(), hidKeyInfo.Name)
-
-	return keyboard.SetupHidPackat(), len(conv.exitKeySequence) == conv.keySequencePos, conv.keySequencePos
+	return &table
 }
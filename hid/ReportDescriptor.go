@@ -0,0 +1,113 @@
+// -*- coding:utf-8; -*-
+
+package hid
+
+// 拡張 HID デバイス (/dev/hidg1) のレポートの最大バイト数
+const EXT_REPORT_LENGTH = 3
+
+// キーボードの report descriptor を返す。
+//
+// ReportMode_Boot の場合は boot protocol 互換の 8 バイトのレポート、
+// ReportMode_NKRO の場合は usage 0x00-0xE7 の bitmap のレポートになる。
+// どちらも LED の output report (5 bit) を持つ。
+func KeyboardReportDescriptor(mode ReportMode) []byte {
+	desc := []byte{
+		0x05, 0x01, // Usage Page (Generic Desktop)
+		0x09, 0x06, // Usage (Keyboard)
+		0xa1, 0x01, // Collection (Application)
+	}
+	if mode == ReportMode_NKRO {
+		desc = append(desc,
+			0x05, 0x07, //   Usage Page (Keyboard)
+			0x19, 0x00, //   Usage Minimum (0x00)
+			0x29, KEY_R_GUI, //   Usage Maximum (0xE7)
+			0x15, 0x00, //   Logical Minimum (0)
+			0x25, 0x01, //   Logical Maximum (1)
+			0x75, 0x01, //   Report Size (1)
+			0x96, byte(NKRO_REPORT_SIZE*8), byte((NKRO_REPORT_SIZE*8)>>8), //   Report Count (232)
+			0x81, 0x02, //   Input (Data,Var,Abs)
+		)
+	} else {
+		desc = append(desc,
+			0x05, 0x07, //   Usage Page (Keyboard)
+			0x19, 0xe0, //   Usage Minimum (0xE0)
+			0x29, 0xe7, //   Usage Maximum (0xE7)
+			0x15, 0x00, //   Logical Minimum (0)
+			0x25, 0x01, //   Logical Maximum (1)
+			0x75, 0x01, //   Report Size (1)
+			0x95, 0x08, //   Report Count (8)
+			0x81, 0x02, //   Input (Data,Var,Abs) modifier
+			0x95, 0x01, //   Report Count (1)
+			0x75, 0x08, //   Report Size (8)
+			0x81, 0x01, //   Input (Const) reserved
+		)
+	}
+	desc = append(desc,
+		0x95, 0x05, //   Report Count (5)
+		0x75, 0x01, //   Report Size (1)
+		0x05, 0x08, //   Usage Page (LEDs)
+		0x19, 0x01, //   Usage Minimum (Num Lock)
+		0x29, 0x05, //   Usage Maximum (Kana)
+		0x91, 0x02, //   Output (Data,Var,Abs)
+		0x95, 0x01, //   Report Count (1)
+		0x75, 0x03, //   Report Size (3)
+		0x91, 0x01, //   Output (Const) padding
+	)
+	if mode != ReportMode_NKRO {
+		desc = append(desc,
+			0x95, 0x06, //   Report Count (6)
+			0x75, 0x08, //   Report Size (8)
+			0x15, 0x00, //   Logical Minimum (0)
+			0x25, 0xff, //   Logical Maximum (255)
+			0x05, 0x07, //   Usage Page (Keyboard)
+			0x19, 0x00, //   Usage Minimum (0)
+			0x29, 0xff, //   Usage Maximum (255)
+			0x81, 0x00, //   Input (Data,Array,Abs) key1-6
+		)
+	}
+	return append(desc, 0xc0) // End Collection
+}
+
+// キーボードのレポートのバイト数を返す。
+func KeyboardReportLength(mode ReportMode) int {
+	if mode == ReportMode_NKRO {
+		return NKRO_REPORT_SIZE
+	}
+	return 8
+}
+
+// 拡張 HID デバイスの report descriptor を返す。
+//
+// Consumer Control (REPORT_ID_Consumer) と System Control (REPORT_ID_System) を持つ。
+func ExtReportDescriptor() []byte {
+	return []byte{
+		0x05, 0x0c, // Usage Page (Consumer)
+		0x09, 0x01, // Usage (Consumer Control)
+		0xa1, 0x01, // Collection (Application)
+		0x85, REPORT_ID_Consumer, //   Report ID
+		0x15, 0x00, //   Logical Minimum (0)
+		0x26, 0xff, 0x03, //   Logical Maximum (0x3FF)
+		0x19, 0x00, //   Usage Minimum (0)
+		0x2a, 0xff, 0x03, //   Usage Maximum (0x3FF)
+		0x75, 0x10, //   Report Size (16)
+		0x95, 0x01, //   Report Count (1)
+		0x81, 0x00, //   Input (Data,Array,Abs)
+		0xc0, // End Collection
+
+		0x05, 0x01, // Usage Page (Generic Desktop)
+		0x09, 0x80, // Usage (System Control)
+		0xa1, 0x01, // Collection (Application)
+		0x85, REPORT_ID_System, //   Report ID
+		0x19, SYSTEM_PowerDown, //   Usage Minimum (Power Down)
+		0x29, SYSTEM_WakeUp, //   Usage Maximum (Wake Up)
+		0x15, 0x01, //   Logical Minimum (1)
+		0x25, 0x03, //   Logical Maximum (3)
+		0x75, 0x02, //   Report Size (2)
+		0x95, 0x01, //   Report Count (1)
+		0x81, 0x60, //   Input (Data,Array,Abs,No Preferred,Null State)
+		0x75, 0x06, //   Report Size (6)
+		0x95, 0x01, //   Report Count (1)
+		0x81, 0x03, //   Input (Const) padding
+		0xc0, // End Collection
+	}
+}
@@ -0,0 +1,199 @@
+package input
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// 入力デバイスの情報
+type DeviceInfo struct {
+	// デバイスノードのパス
+	Fn      string
+	Name    string
+	Phys    string
+	Uniq    string
+	Bustype uint16
+	Vendor  uint16
+	Product uint16
+	Version uint16
+	// EV_KEY で通知可能な linux のキーコード
+	Keys []int
+}
+
+// A-Z の linux キーコード
+var letterKeyCodes = []int{
+	30, 48, 46, 32, 18, 33, 34, 35, 23, 36, 37, 38, 50,
+	49, 24, 25, 16, 19, 31, 20, 22, 47, 17, 45, 21, 44,
+}
+
+// A-Z のキーを全て持つかどうか
+func (info *DeviceInfo) HasLetterKeys() bool {
+	return info.HasKeys(letterKeyCodes)
+}
+
+// codes のキーを全て持つかどうか
+func (info *DeviceInfo) HasKeys(codes []int) bool {
+	keySet := map[int]bool{}
+	for _, key := range info.Keys {
+		keySet[key] = true
+	}
+	for _, code := range codes {
+		if !keySet[code] {
+			return false
+		}
+	}
+	return true
+}
+
+// info に一致する DeviceSelector を返す。
+func (info *DeviceInfo) Selector() *DeviceSelector {
+	vendor := hid.HexUint16(info.Vendor)
+	product := hid.HexUint16(info.Product)
+	bustype := hid.HexUint16(info.Bustype)
+	return &DeviceSelector{
+		Name:          info.Name,
+		Vendor:        &vendor,
+		Product:       &product,
+		Bustype:       &bustype,
+		Phys:          info.Phys,
+		Uniq:          info.Uniq,
+		HasLetterKeys: info.HasLetterKeys(),
+	}
+}
+
+// 入力デバイスの選択条件。
+//
+// 指定されている条件を全て満す入力デバイスを選択する。
+type DeviceSelector struct {
+	// 名前の完全一致
+	Name string `json:",omitempty"`
+	// 名前の glob パターン
+	NameGlob string `json:",omitempty"`
+	// 名前の正規表現
+	NameRegex string `json:",omitempty"`
+	// vendor ID, product ID, bus type の一致
+	Vendor  *hid.HexUint16 `json:",omitempty"`
+	Product *hid.HexUint16 `json:",omitempty"`
+	Bustype *hid.HexUint16 `json:",omitempty"`
+	// phys の glob パターン
+	Phys string `json:",omitempty"`
+	// uniq の glob パターン
+	Uniq string `json:",omitempty"`
+	// A-Z のキーを持つデバイスだけを選択する
+	HasLetterKeys bool `json:",omitempty"`
+	// 持っていなければならない linux のキーコード
+	HasKeys []int `json:",omitempty"`
+
+	nameRegex *regexp.Regexp
+}
+
+// config では、名前の文字列か、条件のオブジェクトで指定する。
+func (selector *DeviceSelector) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*selector = DeviceSelector{Name: name}
+		return nil
+	}
+	// UnmarshalJSON の再帰呼び出しを避けるため別の型にする
+	type plainSelector DeviceSelector
+	var plain plainSelector
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	*selector = DeviceSelector(plain)
+	return selector.compile()
+}
+
+// 正規表現をコンパイルする
+func (selector *DeviceSelector) compile() error {
+	selector.nameRegex = nil
+	if selector.NameRegex != "" {
+		nameRegex, err := regexp.Compile(selector.NameRegex)
+		if err != nil {
+			return err
+		}
+		selector.nameRegex = nameRegex
+	}
+	return nil
+}
+
+// 条件が 1 つも指定されていないかどうか
+func (selector *DeviceSelector) IsEmpty() bool {
+	return selector.Name == "" && selector.NameGlob == "" && selector.NameRegex == "" &&
+		selector.Vendor == nil && selector.Product == nil && selector.Bustype == nil &&
+		selector.Phys == "" && selector.Uniq == "" &&
+		!selector.HasLetterKeys && len(selector.HasKeys) == 0
+}
+
+// info が条件を満すかどうか
+func (selector *DeviceSelector) Match(info *DeviceInfo) bool {
+	if selector.Name != "" && selector.Name != info.Name {
+		return false
+	}
+	if selector.NameGlob != "" && !globMatch(selector.NameGlob, info.Name) {
+		return false
+	}
+	if selector.NameRegex != "" {
+		if selector.nameRegex == nil {
+			if err := selector.compile(); err != nil {
+				return false
+			}
+		}
+		if !selector.nameRegex.MatchString(info.Name) {
+			return false
+		}
+	}
+	if selector.Vendor != nil && uint16(*selector.Vendor) != info.Vendor {
+		return false
+	}
+	if selector.Product != nil && uint16(*selector.Product) != info.Product {
+		return false
+	}
+	if selector.Bustype != nil && uint16(*selector.Bustype) != info.Bustype {
+		return false
+	}
+	if selector.Phys != "" && !globMatch(selector.Phys, info.Phys) {
+		return false
+	}
+	if selector.Uniq != "" && !globMatch(selector.Uniq, info.Uniq) {
+		return false
+	}
+	if selector.HasLetterKeys && !info.HasLetterKeys() {
+		return false
+	}
+	if len(selector.HasKeys) > 0 && !info.HasKeys(selector.HasKeys) {
+		return false
+	}
+	return true
+}
+
+func (selector *DeviceSelector) String() string {
+	if data, err := json.Marshal(selector); err == nil {
+		return string(data)
+	}
+	return selector.Name
+}
+
+func globMatch(pattern, txt string) bool {
+	match, err := filepath.Match(pattern, txt)
+	return err == nil && match
+}
+
+// -kb オプションの値から DeviceSelector を生成する。
+//
+// '{' で始まる場合は JSON の条件、それ以外はキーボード名として扱う。
+func ParseDeviceSelector(txt string) (*DeviceSelector, error) {
+	selector := DeviceSelector{}
+	if strings.HasPrefix(strings.TrimSpace(txt), "{") {
+		if err := json.Unmarshal([]byte(txt), &selector); err != nil {
+			return nil, err
+		}
+	} else {
+		selector.Name = txt
+	}
+	return &selector, nil
+}
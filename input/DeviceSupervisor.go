@@ -0,0 +1,413 @@
+// +build linux,!logger
+
+package input
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	evdev "github.com/gvalkov/golang-evdev"
+
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+const (
+	device_dir = "/dev/input"
+)
+
+// 監視対象のキーボード
+type deviceSlot struct {
+	// 検出対象のキーボードの選択条件
+	selector DeviceSelector
+	// ログ用の名前
+	name string
+	// 接続中のデバイス。未接続の場合は nil。
+	dev *evdev.InputDevice
+	// LED 設定用のデバイス。 LED を持たない場合は nil。
+	ledOut *os.File
+	// このキーボードが押しているキー
+	pressed map[uint8]engine.KeyEvent
+}
+
+// デバイスから読み込んだイベント
+type devEvent struct {
+	slot     *deviceSlot
+	dev      *evdev.InputDevice
+	keyEvent engine.KeyEvent
+	// keyEvent が有効かどうか
+	isKey bool
+	raw   RawEvent
+	err   error
+}
+
+// デバイスから読み込んだ加工前のイベント
+type RawEvent struct {
+	Time time.Time
+	// デバイスのパス
+	Device string
+	Type   uint16
+	Code   uint16
+	Value  int32
+}
+
+// /dev/input を監視し、キーボードの接続・切断に追従して grab するスーパーバイザ。
+//
+// キーボードが接続されると直ちに grab し、
+// 切断されると直ちに、そのキーボードが押していたキーを離す。
+// 他のキーボードで押しているキーは離さない。
+type DeviceSupervisor struct {
+	slots []*deviceSlot
+	// 全キーボードが押しているキー
+	held    *heldKeys
+	eventCh chan devEvent
+	done    chan struct{}
+	// ホストのロック状態
+	ledState hid.LedState
+	ledCh    chan hid.LedState
+	// 加工前のイベントを通知する listener。 nil の場合は通知しない。
+	rawListener func(event RawEvent)
+	// Run の goroutine で実行する処理
+	postCh chan func()
+}
+
+func NewDeviceSupervisor(selectors []DeviceSelector) *DeviceSupervisor {
+	slots := make([]*deviceSlot, 0, len(selectors))
+	for _, selector := range selectors {
+		if !selector.IsEmpty() {
+			slots = append(slots, newDeviceSlot(selector))
+		}
+	}
+	return &DeviceSupervisor{
+		slots:   slots,
+		held:    newHeldKeys(),
+		eventCh: make(chan devEvent),
+		done:    make(chan struct{}),
+		ledCh:   make(chan hid.LedState, 1),
+		postCh:  make(chan func()),
+	}
+}
+
+func newDeviceSlot(selector DeviceSelector) *deviceSlot {
+	name := selector.Name
+	if name == "" {
+		name = selector.String()
+	}
+	return &deviceSlot{
+		selector: selector, name: name, pressed: map[uint8]engine.KeyEvent{}}
+}
+
+// デバイスから読み込んだ全イベントを通知する listener を設定する。
+//
+// Run を呼び出す前に設定すること。
+// listener は Run の listener と同じ goroutine から、キーイベントより先に呼び出す。
+func (sup *DeviceSupervisor) SetRawListener(listener func(event RawEvent)) {
+	sup.rawListener = listener
+}
+
+// 接続中の全キーボードの LED を state に設定する。
+//
+// 任意の goroutine から呼び出せる。
+// 以降に接続されたキーボードにも state を設定する。
+func (sup *DeviceSupervisor) SetLeds(state hid.LedState) {
+	for {
+		select {
+		case sup.ledCh <- state:
+			return
+		default:
+			// 未処理の古い状態は捨てる
+			select {
+			case <-sup.ledCh:
+			default:
+			}
+		}
+	}
+}
+
+// fn を Run の listener と同じ goroutine で実行する。
+//
+// 任意の goroutine から呼び出せる。 Run が動作していない間はブロックする。
+func (sup *DeviceSupervisor) Post(fn func()) {
+	select {
+	case sup.postCh <- fn:
+	case <-sup.done:
+	}
+}
+
+// キーボードを監視し、キーイベントを listener に通知する。
+//
+// listener は 1 つの goroutine から呼び出す。
+// キーボードが切断された時は、そのキーボードが押していたキーを離すイベントを通知する。
+// キーボードの選択条件が無い場合はエラーを返す。
+func (sup *DeviceSupervisor) Run(listener func(keyEvent engine.KeyEvent)) error {
+	if len(sup.slots) == 0 {
+		return errors.New("no keyboard is selected")
+	}
+	defer sup.close()
+
+	changeCh, err := watchDeviceDir(device_dir, sup.done)
+	if err != nil {
+		// inotify が使えない場合はポーリングで代用する
+		log.Warnf("can't watch %s, fallback to polling: %v", device_dir, err)
+		changeCh = pollDeviceDir(sup.done)
+	}
+
+	for _, slot := range sup.slots {
+		log.Infof("[%s] waiting", slot.name)
+	}
+	sup.scan()
+	for {
+		select {
+		case <-changeCh:
+			sup.scan()
+		case fn := <-sup.postCh:
+			fn()
+		case state := <-sup.ledCh:
+			sup.ledState = state
+			for _, slot := range sup.slots {
+				sup.applyLeds(slot)
+			}
+		case event := <-sup.eventCh:
+			if event.slot.dev != event.dev {
+				// 既に切断処理済みのデバイスのイベント
+				continue
+			}
+			if event.err != nil {
+				log.Infof(
+					"[%s] disconnected: %s: %v", event.slot.name, event.dev.Fn, event.err)
+				sup.disconnect(event.slot)
+				for _, keyEvent := range sup.held.release(event.slot.pressed) {
+					log.Debugf("[%s] release %s", event.slot.name, keyEvent.Name)
+					listener(keyEvent)
+				}
+				log.Infof("[%s] waiting", event.slot.name)
+				sup.scan()
+				continue
+			}
+			if sup.rawListener != nil {
+				sup.rawListener(event.raw)
+			}
+			if event.isKey && sup.held.hold(event.slot.pressed, event.keyEvent) {
+				listener(event.keyEvent)
+			}
+		}
+	}
+}
+
+// 未接続のキーボードを探して grab する。
+func (sup *DeviceSupervisor) scan() {
+	connected := map[string]bool{}
+	waiting := false
+	for _, slot := range sup.slots {
+		if slot.dev != nil {
+			connected[slot.dev.Fn] = true
+		} else {
+			waiting = true
+		}
+	}
+	if !waiting {
+		return
+	}
+
+	paths, err := evdev.ListInputDevicePaths(device_glob)
+	if err != nil {
+		log.Errorf("%v", err)
+		return
+	}
+	for _, path := range paths {
+		if connected[path] {
+			continue
+		}
+		dev, err := evdev.Open(path)
+		if err != nil {
+			// udev がパーミッションを設定する前は open できないことがある。
+			// その場合は IN_ATTRIB の通知で再度 scan する。
+			log.Debugf("can't open %s: %v", path, err)
+			continue
+		}
+		info := newDeviceInfo(dev)
+		if info.Name == hid.UINPUT_DEVICE_NAME {
+			// 自身が出力に使う仮想キーボードは入力にしない
+			dev.File.Close()
+			continue
+		}
+		var slot *deviceSlot
+		for _, candidate := range sup.slots {
+			if candidate.dev == nil && candidate.selector.Match(info) {
+				slot = candidate
+				break
+			}
+		}
+		if slot == nil {
+			dev.File.Close()
+			continue
+		}
+		if err := dev.Grab(); err != nil {
+			log.Errorf("[%s] can't grab %s: %v", slot.name, path, err)
+			dev.File.Close()
+			continue
+		}
+		slot.dev = dev
+		connected[path] = true
+		log.Infof("[%s] connected: %s", slot.name, path)
+		if _, hasLed := dev.CapabilitiesFlat[evdev.EV_LED]; hasLed {
+			// golang-evdev は読み込み専用で open するので、 LED 用に別途 open する
+			if ledOut, err := os.OpenFile(path, os.O_WRONLY, 0); err != nil {
+				log.Warnf("[%s] can't open %s for LED: %v", slot.name, path, err)
+			} else {
+				slot.ledOut = ledOut
+				sup.applyLeds(slot)
+			}
+		}
+		go sup.readDevice(slot, dev)
+	}
+}
+
+// slot のキーボードの LED を ledState に合せる。
+func (sup *DeviceSupervisor) applyLeds(slot *deviceSlot) {
+	if slot.ledOut == nil {
+		return
+	}
+	events := make([]evdev.InputEvent, 0, len(hid.LinuxLeds)+1)
+	for _, led := range hid.LinuxLeds {
+		value := int32(0)
+		if sup.ledState&led.State != 0 {
+			value = 1
+		}
+		events = append(events, evdev.InputEvent{
+			Type: evdev.EV_LED, Code: led.Code, Value: value})
+	}
+	events = append(events, evdev.InputEvent{Type: evdev.EV_SYN, Code: evdev.SYN_REPORT})
+	if err := binary.Write(slot.ledOut, binary.LittleEndian, events); err != nil {
+		log.Warnf("[%s] can't set LED: %v", slot.name, err)
+	}
+}
+
+func (sup *DeviceSupervisor) disconnect(slot *deviceSlot) {
+	if slot.dev == nil {
+		return
+	}
+	slot.dev.Release()
+	slot.dev.File.Close()
+	slot.dev = nil
+	if slot.ledOut != nil {
+		slot.ledOut.Close()
+		slot.ledOut = nil
+	}
+}
+
+func (sup *DeviceSupervisor) close() {
+	close(sup.done)
+	for _, slot := range sup.slots {
+		sup.disconnect(slot)
+	}
+}
+
+// dev のイベントを読み込み、 eventCh に送る。
+func (sup *DeviceSupervisor) readDevice(slot *deviceSlot, dev *evdev.InputDevice) {
+	for {
+		events, err := dev.Read()
+		if err != nil {
+			select {
+			case sup.eventCh <- devEvent{slot: slot, dev: dev, err: err}:
+			case <-sup.done:
+			}
+			return
+		}
+		for i := range events {
+			keyEvent, ok := format_event(&events[i])
+			if !ok && sup.rawListener == nil {
+				continue
+			}
+			event := &events[i]
+			raw := RawEvent{
+				Time:   time.Unix(int64(event.Time.Sec), int64(event.Time.Usec)*1000),
+				Device: dev.Fn, Type: event.Type, Code: event.Code, Value: event.Value,
+			}
+			select {
+			case sup.eventCh <- devEvent{
+				slot: slot, dev: dev, keyEvent: keyEvent, isKey: ok, raw: raw}:
+			case <-sup.done:
+				return
+			}
+		}
+	}
+}
+
+// dir のデバイスノードの追加・削除・属性変更を inotify で監視する。
+//
+// 変更があるとチャネルに通知する。 done が close されると監視を終了する。
+func watchDeviceDir(dir string, done <-chan struct{}) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_ATTRIB)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// IN_NONBLOCK の fd を os.File にすることで、 close 時に Read が戻る
+	file := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-done
+		file.Close()
+	}()
+
+	changeCh := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, (syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)*16)
+		for {
+			size, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+			notify := false
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= size; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameBuf := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				name := strings.TrimRight(string(nameBuf), "\x00")
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+				if match, _ := filepath.Match("event*", name); match {
+					log.Debugf("inotify %s 0x%x", name, event.Mask)
+					notify = true
+				}
+			}
+			if notify {
+				select {
+				case changeCh <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changeCh, nil
+}
+
+// inotify が使えない環境用に、定期的に変更を通知する。
+func pollDeviceDir(done <-chan struct{}) <-chan struct{} {
+	changeCh := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case changeCh <- struct{}{}:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return changeCh
+}
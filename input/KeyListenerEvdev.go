@@ -0,0 +1,98 @@
+// +build linux,!logger
+
+package input
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+)
+
+const (
+	device_glob = "/dev/input/event*"
+)
+
+// 入力デバイスの情報リストを返す。
+func ListInputDevices() ([]*DeviceInfo, error) {
+	devices, err := evdev.ListInputDevices(device_glob)
+	if err != nil {
+		return nil, err
+	}
+	defer closeDevices(devices)
+	list := make([]*DeviceInfo, len(devices))
+	for index, dev := range devices {
+		list[index] = newDeviceInfo(dev)
+	}
+	return list, nil
+}
+
+func newDeviceInfo(dev *evdev.InputDevice) *DeviceInfo {
+	info := &DeviceInfo{
+		Fn:      dev.Fn,
+		Name:    dev.Name,
+		Phys:    dev.Phys,
+		Bustype: dev.Bustype,
+		Vendor:  dev.Vendor,
+		Product: dev.Product,
+		Version: dev.Version,
+		Keys:    dev.CapabilitiesFlat[evdev.EV_KEY],
+	}
+	// uniq は golang-evdev で取得できないので sysfs から取得する
+	uniqPath := filepath.Join(
+		"/sys/class/input", filepath.Base(dev.Fn), "device", "uniq")
+	if data, err := ioutil.ReadFile(uniqPath); err == nil {
+		info.Uniq = strings.TrimSpace(string(data))
+	}
+	return info
+}
+
+func closeDevices(devices []*evdev.InputDevice) {
+	for _, dev := range devices {
+		dev.File.Close()
+	}
+}
+
+func format_event(ev *evdev.InputEvent) (engine.KeyEvent, bool) {
+	var code_name string
+
+	code := int(ev.Code)
+
+	switch ev.Type {
+	case evdev.EV_KEY:
+		if code > 0xff {
+			// KeyEvent.Code は uint8 なので、それを越えるコードは扱わない
+			return engine.KeyEvent{}, false
+		}
+		val, haskey := evdev.KEY[code]
+		if haskey {
+			code_name = val
+		} else {
+			val, haskey := evdev.BTN[code]
+			if haskey {
+				code_name = val
+			} else {
+				code_name = "?"
+			}
+		}
+
+		keyEvent := engine.KeyEvent{
+			Code: uint8(code), Pressed: ev.Value > 0, Name: code_name,
+			Time: time.Unix(int64(ev.Time.Sec), int64(ev.Time.Usec)*1000)}
+		log.Debugf("KeyEvent = %v", ev)
+		return keyEvent, true
+	}
+	return engine.KeyEvent{}, false
+}
+
+// selectors の全キーボードを grab し、各キーボードのイベントを listener に通知する。
+//
+// キーボードの接続・切断は DeviceSupervisor が追従する。
+func SetKeyListener(
+	selectors []DeviceSelector, listener func(keyEvent engine.KeyEvent)) error {
+	return NewDeviceSupervisor(selectors).Run(listener)
+}
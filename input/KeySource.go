@@ -0,0 +1,447 @@
+// -*- coding:utf-8; -*-
+
+// Package input は、 evdev やイベントログ等のキーイベントの入力元。
+package input
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+	"github.com/ifritJP/hw-keyboard-remapper/eventlog"
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// ログの出力先
+var log engine.Logger = engine.NopLogger{}
+
+// input パッケージのログの出力先を設定する
+func SetLogger(logger engine.Logger) {
+	log = logger
+}
+
+// キーイベントの入力元。
+//
+// DeviceSupervisor (evdev) の他に、イベントログの再生、標準入力、
+// ソケットからキーイベントを入力できる。
+type KeySource interface {
+	// キーイベントを listener に通知する。
+	//
+	// listener は 1 つの goroutine から呼び出す。
+	// キーボードや接続が途切れた時は、それが押していたキーを離すイベントを通知する。
+	// 入力が終了した場合は nil を返す。
+	Run(listener func(keyEvent engine.KeyEvent)) error
+	// fn を Run の listener と同じ goroutine で実行する。
+	Post(fn func())
+	// 入力元のキーボードの LED を state に設定する
+	SetLeds(state hid.LedState)
+}
+
+// 入力元のデフォルトの指定
+const DEFAULT_KEY_SOURCE = "evdev"
+
+// spec の入力元を開く。
+//
+//	evdev          keyboards のキーボード
+//	replay:<path>  イベントログ (JSON Lines) のキーイベントを、記録された間隔で再生する
+//	stdin          標準入力から 1 行 1 コマンドで入力する
+//	tcp:<addr>     TCP で待ち受け、接続から標準入力と同じ形式で入力する
+//	unix:<path>    unix ドメインソケットで待ち受ける。形式は tcp と同じ。
+func OpenKeySource(spec string, keyboards []DeviceSelector) (KeySource, error) {
+	if spec == "" {
+		spec = DEFAULT_KEY_SOURCE
+	}
+	kind := spec
+	arg := ""
+	if index := strings.Index(spec, ":"); index >= 0 {
+		kind = spec[:index]
+		arg = spec[index+1:]
+	}
+	switch kind {
+	case "evdev":
+		return NewDeviceSupervisor(keyboards), nil
+	case "replay":
+		if arg == "" {
+			return nil, fmt.Errorf("replay file isn't set -- %s", spec)
+		}
+		return OpenReplayKeySource(arg)
+	case "stdin":
+		return NewLineKeySource(os.Stdin), nil
+	case "tcp", "unix":
+		if arg == "" {
+			return nil, fmt.Errorf("address isn't set -- %s", spec)
+		}
+		return ListenSocketKeySource(kind, arg)
+	}
+	return nil, fmt.Errorf("unknown input -- %s", spec)
+}
+
+// 入力元の goroutine から Run の goroutine に送るイベント
+type sourceEvent struct {
+	keyEvent engine.KeyEvent
+	// 入力が終了した。 err は終了の原因。
+	end bool
+	err error
+}
+
+// evdev 以外の入力元の共通処理
+type keySourceLoop struct {
+	eventCh chan sourceEvent
+	postCh  chan func()
+	done    chan struct{}
+}
+
+func newKeySourceLoop() keySourceLoop {
+	return keySourceLoop{
+		eventCh: make(chan sourceEvent),
+		postCh:  make(chan func()),
+		done:    make(chan struct{}),
+	}
+}
+
+func (loop *keySourceLoop) Post(fn func()) {
+	select {
+	case loop.postCh <- fn:
+	case <-loop.done:
+	}
+}
+
+// 物理キーボードが無いので、 LED は設定しない
+func (loop *keySourceLoop) SetLeds(state hid.LedState) {
+	log.Debugf("leds = %v", state)
+}
+
+// event を Run の goroutine に送る。 Run が終了している場合は false を返す。
+func (loop *keySourceLoop) send(event sourceEvent) bool {
+	select {
+	case loop.eventCh <- event:
+		return true
+	case <-loop.done:
+		return false
+	}
+}
+
+func (loop *keySourceLoop) run(listener func(keyEvent engine.KeyEvent)) error {
+	defer close(loop.done)
+	for {
+		select {
+		case fn := <-loop.postCh:
+			fn()
+		case event := <-loop.eventCh:
+			if event.end {
+				return event.err
+			}
+			listener(event.keyEvent)
+		}
+	}
+}
+
+// イベントログのキーイベントを再生する入力元
+type ReplayKeySource struct {
+	keySourceLoop
+	file *os.File
+}
+
+func OpenReplayKeySource(path string) (*ReplayKeySource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayKeySource{newKeySourceLoop(), file}, nil
+}
+
+// 記録されたイベントの間隔で、キーイベントを listener に通知する。
+//
+// タップ・ホールド等のタイマーと合せるため、イベントの時刻は再生した時刻とする。
+func (source *ReplayKeySource) Run(listener func(keyEvent engine.KeyEvent)) error {
+	go func() {
+		defer source.file.Close()
+		err := ReadKeyEventRecords(source.file, func(keyEvent engine.KeyEvent, wait time.Duration) bool {
+			time.Sleep(wait)
+			keyEvent.Time = time.Time{}
+			return source.send(sourceEvent{keyEvent: keyEvent})
+		})
+		source.send(sourceEvent{end: true, err: err})
+	}()
+	return source.run(listener)
+}
+
+// reader のイベントログから、キーイベントのレコードを順に handler に渡す。
+//
+// wait は前のキーイベントからの経過時間。 handler が false を返すと終了する。
+func ReadKeyEventRecords(
+	reader io.Reader, handler func(keyEvent engine.KeyEvent, wait time.Duration) bool) error {
+	decoder := json.NewDecoder(reader)
+	var prev time.Time
+	for {
+		var record eventlog.EventRecord
+		if err := decoder.Decode(&record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if record.Type != eventlog.EventRecord_Key {
+			continue
+		}
+		wait := time.Duration(0)
+		if !prev.IsZero() && !record.Time.IsZero() && record.Time.After(prev) {
+			wait = record.Time.Sub(prev)
+		}
+		if !record.Time.IsZero() {
+			prev = record.Time
+		}
+		if !handler(record.KeyEvent(), wait) {
+			return nil
+		}
+	}
+}
+
+// 1 行 1 コマンドでキーイベントを入力する入力元。
+//
+//	down <key>   key を押す
+//	up <key>     key を離す
+//	tap <key>    key を押して離す
+//	sleep <ms>   ms ミリ秒待つ
+//	{...}        イベントログのキーイベントのレコード
+//
+// key は linux のキー名 ("KEY_A", "leftctrl" 等) かキーコード。
+// 空行と # で始まる行は無視する。
+type LineKeySource struct {
+	keySourceLoop
+	reader io.Reader
+}
+
+func NewLineKeySource(reader io.Reader) *LineKeySource {
+	return &LineKeySource{newKeySourceLoop(), reader}
+}
+
+func (source *LineKeySource) Run(listener func(keyEvent engine.KeyEvent)) error {
+	go func() {
+		err := ReadKeyLines(source.reader, func(keyEvent engine.KeyEvent, wait time.Duration) bool {
+			time.Sleep(wait)
+			return source.send(sourceEvent{keyEvent: keyEvent})
+		})
+		source.send(sourceEvent{end: true, err: err})
+	}()
+	return source.run(listener)
+}
+
+// reader の各行のコマンドを KeyEvent に変換し、 handler に渡す。
+//
+// wait は前のキーイベントからの待ち時間で、 sleep の合計か、
+// イベントログのレコードの時刻の差。 handler 側で待つ。
+// 不正な行はログに出力して無視する。 handler が false を返すと終了する。
+func ReadKeyLines(
+	reader io.Reader, handler func(keyEvent engine.KeyEvent, wait time.Duration) bool) error {
+	scanner := bufio.NewScanner(reader)
+	lineNo := 0
+	wait := time.Duration(0)
+	// 最後のイベントログのレコードの時刻
+	var prev time.Time
+	for scanner.Scan() {
+		lineNo++
+		keyEvents, sleep, err := parseKeyLine(scanner.Text())
+		if err != nil {
+			log.Errorf("line %d: %v", lineNo, err)
+			continue
+		}
+		wait += sleep
+		for _, keyEvent := range keyEvents {
+			if !keyEvent.Time.IsZero() {
+				if !prev.IsZero() && keyEvent.Time.After(prev) {
+					wait += keyEvent.Time.Sub(prev)
+				}
+				prev = keyEvent.Time
+				keyEvent.Time = time.Time{}
+			}
+			if !handler(keyEvent, wait) {
+				return nil
+			}
+			wait = 0
+		}
+	}
+	return scanner.Err()
+}
+
+// line のコマンドを KeyEvent と sleep の時間に変換する。
+//
+// イベントログのレコードの KeyEvent は、記録された時刻を持つ。
+func parseKeyLine(line string) ([]engine.KeyEvent, time.Duration, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, 0, nil
+	}
+	if strings.HasPrefix(line, "{") {
+		var record eventlog.EventRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, 0, err
+		}
+		if record.Type != eventlog.EventRecord_Key {
+			return nil, 0, nil
+		}
+		return []engine.KeyEvent{record.KeyEvent()}, 0, nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return nil, 0, fmt.Errorf("illegal command -- %s", line)
+	}
+	command, arg := strings.ToLower(fields[0]), fields[1]
+	if command == "sleep" {
+		ms, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, 0, fmt.Errorf("illegal sleep time -- %s", arg)
+		}
+		return nil, time.Duration(ms) * time.Millisecond, nil
+	}
+	code, err := eventlog.ParseLinuxKeyName(arg)
+	if err != nil {
+		return nil, 0, err
+	}
+	name := eventlog.LinuxKeyName(code)
+	down := engine.KeyEvent{Code: code, Pressed: true, Name: name}
+	up := engine.KeyEvent{Code: code, Pressed: false, Name: name}
+	switch command {
+	case "down":
+		return []engine.KeyEvent{down}, 0, nil
+	case "up":
+		return []engine.KeyEvent{up}, 0, nil
+	case "tap":
+		return []engine.KeyEvent{down, up}, 0, nil
+	}
+	return nil, 0, fmt.Errorf("unknown command -- %s", command)
+}
+
+// 複数の入力元 (キーボードや接続) が押しているキー。
+//
+// 入力元が途切れた時に、その入力元が押していたキーだけを離すために使う。
+// 複数の入力元が同じキーを押している場合は、全ての入力元が離すまで押したままにする。
+type heldKeys struct {
+	mutex sync.Mutex
+	// linux のキーコード → そのキーを押している入力元の数
+	holders map[uint8]int
+}
+
+func newHeldKeys() *heldKeys {
+	return &heldKeys{holders: map[uint8]int{}}
+}
+
+// 入力元が押しているキー pressed と、全入力元の holders に keyEvent を反映する。
+//
+// 他の入力元が押しているキーを離すイベントと、押していないキーを離すイベントは
+// false を返すので、 Run の listener に渡さないこと。
+func (held *heldKeys) hold(pressed map[uint8]engine.KeyEvent, keyEvent engine.KeyEvent) bool {
+	held.mutex.Lock()
+	defer held.mutex.Unlock()
+	_, has := pressed[keyEvent.Code]
+	if keyEvent.Pressed {
+		if !has {
+			pressed[keyEvent.Code] = keyEvent
+			held.holders[keyEvent.Code]++
+		}
+		return true
+	}
+	if !has {
+		return false
+	}
+	delete(pressed, keyEvent.Code)
+	held.holders[keyEvent.Code]--
+	if held.holders[keyEvent.Code] > 0 {
+		return false
+	}
+	delete(held.holders, keyEvent.Code)
+	return true
+}
+
+// 途切れた入力元が押していたキー pressed を離し、 listener に渡すイベントを返す。
+func (held *heldKeys) release(pressed map[uint8]engine.KeyEvent) []engine.KeyEvent {
+	keyEvents := []engine.KeyEvent{}
+	for _, keyEvent := range pressed {
+		keyEvent.Pressed = false
+		keyEvent.Time = time.Time{}
+		if held.hold(pressed, keyEvent) {
+			keyEvents = append(keyEvents, keyEvent)
+		}
+	}
+	return keyEvents
+}
+
+// ソケットで待ち受け、接続から LineKeySource と同じ形式で入力する入力元。
+//
+// 接続が切れると、その接続が押していたキーを離す。
+// 複数の接続が同じキーを押している場合は、全ての接続が離すまで押したままにする。
+// 認証は無いので、 tcp をループバック以外で待ち受ける場合は警告する。
+type SocketKeySource struct {
+	keySourceLoop
+	listener net.Listener
+	held     *heldKeys
+}
+
+// network ("tcp" か "unix") の address で待ち受ける
+func ListenSocketKeySource(network, address string) (*SocketKeySource, error) {
+	if network == "unix" {
+		// 前回のソケットが残っている場合は削除する
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		// -v 無しでも表示されるように Error で出力する
+		log.Errorf("%v accepts key events from other hosts without authentication. "+
+			"listen on 127.0.0.1 unless it is a trusted network", listener.Addr())
+	}
+	return &SocketKeySource{
+		keySourceLoop: newKeySourceLoop(),
+		listener:      listener,
+		held:          newHeldKeys(),
+	}, nil
+}
+
+func (source *SocketKeySource) Run(listener func(keyEvent engine.KeyEvent)) error {
+	log.Infof("listen %v", source.listener.Addr())
+	go func() {
+		for {
+			conn, err := source.listener.Accept()
+			if err != nil {
+				source.send(sourceEvent{end: true, err: err})
+				return
+			}
+			go source.serve(conn)
+		}
+	}()
+	defer source.listener.Close()
+	return source.run(listener)
+}
+
+func (source *SocketKeySource) serve(conn net.Conn) {
+	defer conn.Close()
+	log.Infof("connected: %v", conn.RemoteAddr())
+	// この接続が押しているキー
+	pressed := map[uint8]engine.KeyEvent{}
+	err := ReadKeyLines(conn, func(keyEvent engine.KeyEvent, wait time.Duration) bool {
+		time.Sleep(wait)
+		if !source.held.hold(pressed, keyEvent) {
+			return true
+		}
+		return source.send(sourceEvent{keyEvent: keyEvent})
+	})
+	log.Infof("disconnected: %v: %v", conn.RemoteAddr(), err)
+	// キーが押されたままにならないように、この接続が押していたキーを離す
+	for _, keyEvent := range source.held.release(pressed) {
+		if !source.send(sourceEvent{keyEvent: keyEvent}) {
+			break
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// -*- coding:utf-8; -*-
+
+package input
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+)
+
+// linux のキーコード
+const (
+	linux_KEY_A         = 30
+	linux_KEY_X         = 45
+	linux_KEY_LEFTSHIFT = 42
+)
+
+func TestHeldKeysReleaseOnlyLostInput(t *testing.T) {
+	held := newHeldKeys()
+	left := map[uint8]engine.KeyEvent{}
+	right := map[uint8]engine.KeyEvent{}
+	press := func(pressed map[uint8]engine.KeyEvent, code uint8) bool {
+		return held.hold(pressed, engine.KeyEvent{Code: code, Pressed: true})
+	}
+
+	// 分割キーボードの左右で shift を押し、右で x を押す
+	if !press(left, linux_KEY_LEFTSHIFT) || !press(right, linux_KEY_LEFTSHIFT) ||
+		!press(right, linux_KEY_X) {
+		t.Fatal("press must be passed to the listener")
+	}
+	// キーリピート
+	if !press(right, linux_KEY_X) {
+		t.Error("key repeat must be passed to the listener")
+	}
+
+	// 右が切断されても、左で押している shift は離さない
+	released := held.release(right)
+	if len(released) != 1 || released[0].Code != linux_KEY_X || released[0].Pressed {
+		t.Errorf("released %v, expected only x", released)
+	}
+	if len(right) != 0 {
+		t.Errorf("%v is left in the lost input", right)
+	}
+
+	// 押していないキーを離すイベントは渡さない
+	if held.hold(right, engine.KeyEvent{Code: linux_KEY_A}) {
+		t.Error("release of a key which isn't pressed must be dropped")
+	}
+	if !held.hold(left, engine.KeyEvent{Code: linux_KEY_LEFTSHIFT}) {
+		t.Error("release of the last holder must be passed to the listener")
+	}
+	if len(held.holders) != 0 {
+		t.Errorf("holders %v is left", held.holders)
+	}
+}
+
+func TestParseKeyLine(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected []engine.KeyEvent
+		sleep    time.Duration
+		ok       bool
+	}{
+		{"", nil, 0, true},
+		{"  # comment", nil, 0, true},
+		{"down a", []engine.KeyEvent{{Code: linux_KEY_A, Pressed: true, Name: "KEY_A"}}, 0, true},
+		{"UP KEY_A", []engine.KeyEvent{{Code: linux_KEY_A, Name: "KEY_A"}}, 0, true},
+		{"tap x", []engine.KeyEvent{
+			{Code: linux_KEY_X, Pressed: true, Name: "KEY_X"}, {Code: linux_KEY_X, Name: "KEY_X"}}, 0, true},
+		{"sleep 150", nil, 150 * time.Millisecond, true},
+		// イベントログのキーのレコードは時刻を持つ
+		{`{"time":"2020-01-02T03:04:05Z","type":"key","code":42,"pressed":true}`,
+			[]engine.KeyEvent{{
+				Code: linux_KEY_LEFTSHIFT, Pressed: true, Name: "KEY_LEFTSHIFT",
+				Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}},
+			0, true},
+		// キー以外のレコードは読み飛ばす
+		{`{"type":"report","kind":"keyboard","data":"0000000000000000"}`, nil, 0, true},
+		{`{"type":`, nil, 0, false},
+		{"down", nil, 0, false},
+		{"down a b", nil, 0, false},
+		{"sleep x", nil, 0, false},
+		{"press a", nil, 0, false},
+		{"down nokey", nil, 0, false},
+	}
+	for _, testCase := range cases {
+		keyEvents, sleep, err := parseKeyLine(testCase.line)
+		if (err == nil) != testCase.ok || sleep != testCase.sleep ||
+			!reflect.DeepEqual(keyEvents, testCase.expected) {
+			t.Errorf("%q: %v %v %v", testCase.line, keyEvents, sleep, err)
+		}
+	}
+}
+
+func TestReadKeyLines(t *testing.T) {
+	cases := []struct {
+		name     string
+		lines    []string
+		count    int
+		expected []string
+	}{
+		{
+			// sleep は次のイベントの待ち時間にまとめる。不正な行は読み飛ばす。
+			"commands", []string{
+				"down leftshift", "sleep 10", "# comment", "sleep 20", "tap a", "bad line",
+				"up leftshift"},
+			-1,
+			[]string{"KEY_LEFTSHIFT down 0s", "KEY_A down 30ms", "KEY_A up 0s", "KEY_LEFTSHIFT up 0s"},
+		},
+		{
+			// レコードの時刻の差を待ち時間にする。時刻は KeyEvent に残さない。
+			"records", []string{
+				`{"time":"2020-01-02T03:04:05Z","type":"key","code":30,"pressed":true}`,
+				`{"time":"2020-01-02T03:04:05.1Z","type":"report","data":"00"}`,
+				"sleep 5",
+				`{"time":"2020-01-02T03:04:05.25Z","type":"key","code":30}`},
+			-1,
+			[]string{"KEY_A down 0s", "KEY_A up 255ms"},
+		},
+		{
+			// handler が false を返すと読み込みを止める
+			"stop", []string{"tap a", "tap x"},
+			3,
+			[]string{"KEY_A down 0s", "KEY_A up 0s", "KEY_X down 0s"},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			events := []string{}
+			reader := strings.NewReader(strings.Join(testCase.lines, "\n"))
+			err := ReadKeyLines(reader, func(keyEvent engine.KeyEvent, wait time.Duration) bool {
+				state := "up"
+				if keyEvent.Pressed {
+					state = "down"
+				}
+				if !keyEvent.Time.IsZero() {
+					t.Errorf("%v has time", keyEvent)
+				}
+				events = append(events, fmt.Sprintf("%s %s %v", keyEvent.Name, state, wait))
+				return len(events) != testCase.count
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(events, testCase.expected) {
+				t.Errorf("%q, expected %q", events, testCase.expected)
+			}
+		})
+	}
+}
@@ -3,14 +3,21 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"strconv"
-
 	"github.com/sirupsen/logrus"
+
+	"github.com/ifritJP/hw-keyboard-remapper/config"
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+	"github.com/ifritJP/hw-keyboard-remapper/eventlog"
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+	"github.com/ifritJP/hw-keyboard-remapper/input"
+	"github.com/ifritJP/hw-keyboard-remapper/output"
 )
 
 func setSignal(callback func()) {
@@ -26,6 +33,72 @@ func setSignal(callback func()) {
 	}()
 }
 
+// path のテキストを読み込む。 path が "-" の場合は標準入力から読み込む。
+func readText(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(string(data), "\r\n", "\n"), nil
+}
+
+// ユーザに入力デバイスを 1 つ選択させ、その名前の選択条件を返す。
+func selectDevice() (*input.DeviceSelector, error) {
+	list, err := input.ListInputDevices()
+	if err != nil {
+		return nil, err
+	}
+	devices := []*input.DeviceInfo{}
+	for _, info := range list {
+		if info.Name != hid.UINPUT_DEVICE_NAME {
+			devices = append(devices, info)
+		}
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no accessible input devices found")
+	}
+
+	lines := make([]string, len(devices))
+	max := 0
+	for index, info := range devices {
+		lines[index] = fmt.Sprintf("%-3d %-20s %-35s %s", index, info.Fn, info.Name, info.Phys)
+		if len(lines[index]) > max {
+			max = len(lines[index])
+		}
+	}
+	fmt.Printf("%-3s %-20s %-35s %s\n", "ID", "Device", "Name", "Phys")
+	fmt.Println(strings.Repeat("-", max))
+	fmt.Println(strings.Join(lines, "\n"))
+	for {
+		fmt.Printf("Select device [0-%d]: ", len(devices)-1)
+		var choice int
+		if _, err := fmt.Scan(&choice); err != nil {
+			return nil, err
+		}
+		if choice >= 0 && choice < len(devices) {
+			return &input.DeviceSelector{Name: devices[choice].Name}, nil
+		}
+	}
+}
+
+// 複数回指定可能な文字列オプション
+type stringListFlag []string
+
+func (list *stringListFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringListFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 func main() {
 
 	var cmd = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
@@ -40,12 +113,34 @@ func main() {
 
 	verboseMode := cmd.Bool("v", false, "verbose")
 	configPath := cmd.String("conf", "", "config file path")
-	keyboardOp := cmd.String("kb", "", "keyboard name")
+	var keyboardOp stringListFlag
+	cmd.Var(&keyboardOp, "kb",
+		"keyboard name or JSON selector. specify it multiple times to merge keyboards")
 	logLevel := cmd.Int(
 		"log", int(logrus.DebugLevel),
 		fmt.Sprintf("log level %d - %d", logrus.FatalLevel, logrus.TraceLevel))
 
-	opMode := cmd.String("mode", "remap", "operation mode. [remap,list,scan]")
+	opMode := cmd.String(
+		"mode", "remap",
+		"operation mode. [remap,record,simulate,list,scan,check,type,gadget-setup,gadget-teardown]")
+	configFsRoot := cmd.String(
+		"configfs", "", "configfs usb_gadget directory for gadget-setup/gadget-teardown")
+	typeFile := cmd.String("file", "-", "text file to type with -mode type. '-' is stdin")
+	recordOp := cmd.String(
+		"record", "", "event log (JSON Lines) to write with -mode record. '-' is stdout")
+	layoutOp := cmd.String("layout", "", "host keyboard layout. [us,jis,de]")
+	controlOp := cmd.String("control", "", "unix domain socket path to control remap mode")
+	inputOp := cmd.String(
+		"input", "",
+		"key event input. [evdev,replay:<path>,stdin,tcp:<addr>,unix:<path>] (default evdev)")
+	outputOp := cmd.String(
+		"output", "",
+		"report output. [hidg,hidg:<kb>[,<ext>],uinput,file:<path>,none] (default hidg)")
+	sessionOp := cmd.String(
+		"session", "",
+		"session file (event log or stdin commands) to run with -mode simulate. '-' is stdin")
+	diffOp := cmd.String(
+		"diff", "", "config file to compare with -conf on the same session with -mode simulate")
 
 	if len(os.Args) <= 1 {
 		cmd.Usage()
@@ -55,14 +150,24 @@ func main() {
 		cmd.Usage()
 	}
 	if *opMode == "list" {
-		if list, err := ListInputDevices(); err != nil {
+		if list, err := input.ListInputDevices(); err != nil {
 			logrus.Error(err)
 		} else {
 			if len(list) == 0 {
 				fmt.Printf("It maybe need to use sudo command.\n")
 			} else {
-				for _, name := range list {
-					fmt.Printf("'%s'\n", name)
+				for _, info := range list {
+					fmt.Printf("'%s'\n", info.Name)
+					fmt.Printf("  device  : %s\n", info.Fn)
+					fmt.Printf("  phys    : %s\n", info.Phys)
+					fmt.Printf("  uniq    : %s\n", info.Uniq)
+					fmt.Printf(
+						"  bus 0x%04x, vendor 0x%04x, product 0x%04x, version 0x%04x\n",
+						info.Bustype, info.Vendor, info.Product, info.Version)
+					fmt.Printf(
+						"  keys    : %d (letter keys %v)\n",
+						len(info.Keys), info.HasLetterKeys())
+					fmt.Printf("  selector: %s\n", info.Selector())
 				}
 			}
 			os.Exit(1)
@@ -78,96 +183,365 @@ func main() {
 	} else {
 		logrus.SetLevel(logrus.ErrorLevel)
 	}
+	input.SetLogger(logrus.StandardLogger())
+	output.SetLogger(logrus.StandardLogger())
 
-	convCode := NewCode2HidCode("qweqweqweqwe")
-	hidKeyboard := NewHIDKeyboard()
+	if *opMode == "check" {
+		if *configPath == "" {
+			fmt.Printf("config isn't set. Please set -conf option.\n")
+			os.Exit(1)
+		}
+		problems, warnings, err := config.CheckConfig(*configPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, problem := range append(problems, warnings...) {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s: ok\n", *configPath)
+		os.Exit(0)
+	}
 
-	keyboardName := ""
 	logrus.Infof("configPath = %v", configPath)
-	if *configPath != "" {
-		if setting, err := load(*configPath); err != nil {
-			logrus.Error(err)
-			os.Exit(1)
-		} else {
-			logrus.Infof("config.json = %v", setting)
-			if setting.InputKeyboardName != nil {
-				keyboardName = *setting.InputKeyboardName
+	// config を読み込み、キーの処理系を構築する
+	loadRemapper := func() (*config.Setting, *engine.Remapper, error) {
+		setting := &config.Setting{}
+		if *configPath != "" {
+			var err error
+			if setting, err = config.Load(*configPath); err != nil {
+				return nil, nil, err
 			}
-			for _, switchKey := range setting.SwitchKeys {
-				if switchKey.On == nil || *switchKey.On {
-					convCode.SetHIDRemap(switchKey.Src, switchKey.Dst)
-				}
-			}
-			for codeTxt, convKeyList := range setting.ConvKeyMap {
-				for _, convKey := range convKeyList {
-					if code, err := strconv.ParseUint(codeTxt, 0, 8); err != nil {
-						logrus.Error(err)
-					} else {
-						if convKey.On == nil || *convKey.On {
-							// AddConvKey() する ConvKeyInfo 情報のオブジェクトを
-							// 別々にするため、 cloneConvKey を作る。
-							cloneConvKey := convKey
-							hidKeyboard.AddConvKey(byte(code), &cloneConvKey)
-						}
-					}
-				}
+			logrus.Infof("config.json = %v", setting)
+		}
+		remapper, err := config.NewRemapper(setting, *layoutOp, logrus.StandardLogger())
+		return setting, remapper, err
+	}
+	setting, remapper, err := loadRemapper()
+	if err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
+	keyboards := []input.DeviceSelector(setting.InputKeyboardName)
+	gadgetSetting := &setting.Gadget
+	controlSocket := setting.ControlSocket
+	if *controlOp != "" {
+		controlSocket = *controlOp
+	}
+	inputSpec := setting.Input
+	if *inputOp != "" {
+		inputSpec = *inputOp
+	}
+	outputSpec := setting.Output
+	if *outputOp != "" {
+		outputSpec = *outputOp
+	}
+	if len(keyboardOp) > 0 {
+		keyboards = []input.DeviceSelector{}
+		for _, txt := range keyboardOp {
+			if selector, err := input.ParseDeviceSelector(txt); err != nil {
+				logrus.Error(err)
+				os.Exit(1)
+			} else {
+				keyboards = append(keyboards, *selector)
 			}
 		}
 	}
-	if *keyboardOp != "" {
-		keyboardName = *keyboardOp
+
+	if *opMode == "gadget-setup" || *opMode == "gadget-teardown" {
+		if *configFsRoot != "" {
+			gadgetSetting.ConfigFsRoot = *configFsRoot
+		}
+		gadget := output.NewGadget(gadgetSetting, remapper.Keyboard.GetReportMode())
+		if *opMode == "gadget-setup" {
+			err = gadget.Setup()
+		} else {
+			err = gadget.Teardown()
+		}
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *opMode == "simulate" {
+		// デバイスを使わずに、入力のセッションを設定に通した結果を出力する
+		keyEvents, err := readSimulateInput(*sessionOp)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		blocks := simulate(remapper, keyEvents)
+		if *diffOp == "" {
+			printSimulateBlocks(blocks)
+			os.Exit(0)
+		}
+		otherSetting, err := config.Load(*diffOp)
+		var other *engine.Remapper
+		if err == nil {
+			other, err = config.NewRemapper(otherSetting, *layoutOp, logrus.StandardLogger())
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if printSimulateDiff(blocks, simulate(other, keyEvents), *configPath, *diffOp) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
 	if *opMode == "scan" {
 		logrus.SetLevel(logrus.DebugLevel)
-		logrus.Infof("Detecting keyboard = %s", keyboardName)
-		logrus.Infof(
-			"Enter '%s', if you want to exit from this program.",
-			convCode.GetExitKeySequenceTxt())
-		SetKeyListener(keyboardName, func(keyEvent KeyEvent) {
-			data, _, _ := convCode.ProcessKeyEvent(hidKeyboard, keyEvent)
-			logrus.Printf("data %v", data)
+		logrus.Infof("Detecting keyboard = %v", keyboards)
+		for _, hotkey := range remapper.Hotkeys() {
+			logrus.Infof("hotkey %v", hotkey)
+		}
+		processor := remapper.Processor
+		if (inputSpec == "" || inputSpec == input.DEFAULT_KEY_SOURCE) && len(keyboards) == 0 {
+			// キーボードの指定がない場合はユーザに選択させる
+			selector, err := selectDevice()
+			if err != nil {
+				logrus.Error(err)
+				os.Exit(1)
+			}
+			keyboards = []input.DeviceSelector{*selector}
+		}
+		source, err := input.OpenKeySource(inputSpec, keyboards)
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		handleReports := func(reports []hid.HIDReport, action engine.HotkeyAction) {
+			logrus.Printf("reports %v", reports)
+			if action != engine.HotkeyAction_None {
+				logrus.Printf("hotkey action %v", action)
+			}
+		}
+		err = source.Run(func(keyEvent engine.KeyEvent) {
+			handleReports(processor.ProcessKeyEvent(keyEvent))
+			processor.ScheduleExpire(source.Post, handleReports)
 		})
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
-	if keyboardName == "" {
+	if *opMode == "type" {
+		text, err := readText(*typeFile)
+		var macro *engine.Macro
+		if err == nil {
+			macro, err = engine.NewTextMacro("type", remapper.TextLayout, text)
+		}
+		var sink output.ReportSink
+		if err == nil {
+			sink, err = output.OpenReportSink(outputSpec)
+		}
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		remapper.Processor.GetMacroPlayer().Play(macro, remapper.Keyboard, func(reports []hid.HIDReport) {
+			output.WriteReports(sink, reports)
+		})
+		sink.Close()
+		os.Exit(0)
+	}
+
+	if (inputSpec == "" || inputSpec == input.DEFAULT_KEY_SOURCE) && len(keyboards) == 0 {
 		fmt.Printf("keyboard isn't set. Please set -kb option or set config.\n")
 		os.Exit(1)
 	}
 
-	hidOut, err := os.OpenFile("/dev/hidg0", os.O_RDWR, os.ModeCharDevice)
+	if *opMode == "record" {
+		if *recordOp == "" {
+			fmt.Printf("event log isn't set. Please set -record option.\n")
+			os.Exit(1)
+		}
+		if *outputOp == "" {
+			// record モードでは、 -output を指定した場合だけレポートを転送する
+			outputSpec = "none"
+		}
+		if *recordOp == "-" && outputSpec == "file:-" {
+			fmt.Printf("-record and -output can't both write to stdout.\n")
+			os.Exit(1)
+		}
+	}
+	sink, err := output.OpenReportSink(outputSpec)
 	if err != nil {
 		logrus.Error(err)
 		os.Exit(1)
 	}
+	// record モードのイベントログ。それ以外は nil。
+	var recorder *eventlog.Writer
+	if *opMode == "record" {
+		if recorder, err = eventlog.OpenWriter(*recordOp); err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		sink = output.NewRecordingOutput(sink, recorder)
+	}
+	record := func(entry eventlog.EventRecord) {
+		if recorder != nil {
+			if err := recorder.Write(entry); err != nil {
+				logrus.Errorf("record: %v", err)
+			}
+		}
+	}
 
-	logrus.Infof("keyboardName = %s", keyboardName)
+	logrus.Infof("keyboards = %v", keyboards)
+	var controlServer *ControlServer
+	logrus.Infof("Detecting keyboard = %v", keyboards)
+	for _, hotkey := range remapper.Hotkeys() {
+		logrus.Infof("hotkey %v", hotkey)
+	}
+	source, err := input.OpenKeySource(inputSpec, keyboards)
+	if err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
 	setSignal(func() {
-		// 強制停止の時に、変な data を送信したままにしないように
-		// 全 0 のデータでクリアする
-		zeroData := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-		hidOut.Write(zeroData)
-		hidOut.Write(zeroData)
+		// remapper と sink は source の goroutine で扱うので、後始末もそこで行なう。
+		// source が応答しない場合は待たずに終了する。
+		done := make(chan struct{})
+		go source.Post(func() {
+			if controlServer != nil {
+				controlServer.Close()
+			}
+			// 強制停止の時に、変な data を送信したままにしないように
+			// 全 0 のデータでクリアする
+			output.WriteReports(sink, remapper.Keyboard.ZeroReports())
+			output.WriteReports(sink, remapper.Keyboard.ZeroReports())
+			sink.Close()
+			close(done)
+		})
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			logrus.Warnf("timeout to clear the reports")
+		}
 	})
-	for {
-		hidKeyboard.ReleaseAllKeys()
-		logrus.Infof("Detecting keyboard = %s", keyboardName)
-		logrus.Infof(
-			"Enter '%s', if you want to exit from this program.",
-			convCode.GetExitKeySequenceTxt())
-		SetKeyListener(keyboardName, func(keyEvent KeyEvent) {
-			data, matchkeySeq, keySeqPos :=
-				convCode.ProcessKeyEvent(hidKeyboard, keyEvent)
-			logrus.Debugf("data %v, %d", data, keySeqPos)
-			if matchkeySeq {
-				logrus.Printf("match key sequence")
-				zeroData := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-				hidOut.Write(zeroData)
-				os.Exit(0)
+	if supervisor, ok := source.(*input.DeviceSupervisor); ok && recorder != nil {
+		supervisor.SetRawListener(func(event input.RawEvent) {
+			record(eventlog.NewEvdevRecord(
+				event.Time, event.Device, event.Type, event.Code, event.Value))
+		})
+	}
+	// remapper は reload で置き換わるので、以降の処理は全て source の goroutine で
+	// remapper を参照する
+	// ホストのロック状態
+	hostLedState := hid.LedState(0)
+	// 物理キーボードの LED を更新する。バイパス中は Scroll Lock を点灯する。
+	updateLeds := func() {
+		state := hostLedState
+		if remapper.Processor.IsBypass() {
+			state |= hid.LED_ScrollLock
+		}
+		source.SetLeds(state)
+	}
+	if leds := sink.Leds(); leds != nil {
+		go func() {
+			// ホストからの LED output report を物理キーボードに反映する
+			err := hid.ReadLedReports(leds, func(state hid.LedState) {
+				source.Post(func() {
+					logrus.Infof("host lock state = %v", state)
+					hostLedState = state
+					remapper.Keyboard.SetLockState(state)
+					updateLeds()
+				})
+			})
+			if err != nil {
+				logrus.Errorf("LED output report: %v", err)
+			}
+		}()
+	}
+	handleReports := func(reports []hid.HIDReport, action engine.HotkeyAction) {
+		logrus.Debugf("reports %v", reports)
+		output.WriteReports(sink, reports)
+		if action != engine.HotkeyAction_None {
+			record(eventlog.NewHotkeyRecord(action, time.Now()))
+		}
+		switch action {
+		case engine.HotkeyAction_Exit:
+			logrus.Printf("match exit hotkey")
+			output.WriteReports(sink, remapper.Keyboard.ZeroReports())
+			sink.Close()
+			os.Exit(0)
+		case engine.HotkeyAction_Pause:
+			output.WriteReports(
+				sink, remapper.Processor.SetPaused(!remapper.Processor.IsPaused()))
+		case engine.HotkeyAction_Bypass:
+			output.WriteReports(
+				sink, remapper.Processor.SetBypass(!remapper.Processor.IsBypass()))
+			updateLeds()
+		case engine.HotkeyAction_Reload:
+			_, newRemapper, err := loadRemapper()
+			if err != nil {
+				logrus.Errorf("reload: %v", err)
+				return
+			}
+			newRemapper.TakeOver(remapper)
+			remapper.Processor.StopTimer()
+			output.WriteReports(sink, remapper.Processor.Reset())
+			remapper = newRemapper
+			logrus.Infof("reloaded %s", *configPath)
+			for _, hotkey := range remapper.Hotkeys() {
+				logrus.Infof("hotkey %v", hotkey)
 			}
-			hidOut.Write(data)
+		}
+	}
+	if controlSocket != "" {
+		controlServer, err = ListenControl(controlSocket, func(command, arg string) error {
+			result := make(chan error, 1)
+			source.Post(func() {
+				var macro *engine.Macro
+				var err error
+				switch command {
+				case "type":
+					macro, err = engine.NewTextMacro("type", remapper.TextLayout, arg)
+				case "macro":
+					if macro = remapper.Processor.GetMacro(arg); macro == nil {
+						err = fmt.Errorf("unknown macro -- %s", arg)
+					}
+				default:
+					err = fmt.Errorf("unknown command -- %s", command)
+				}
+				if err == nil {
+					handleReports(remapper.Processor.PlayMacro(macro))
+					remapper.Processor.ScheduleExpire(source.Post, handleReports)
+				}
+				result <- err
+			})
+			return <-result
 		})
-		time.Sleep(1 * time.Second)
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+	}
+	err = source.Run(func(keyEvent engine.KeyEvent) {
+		if recorder != nil {
+			if keyEvent.Time.IsZero() {
+				keyEvent.Time = time.Now()
+			}
+			record(eventlog.NewKeyEventRecord(keyEvent))
+		}
+		handleReports(remapper.Processor.ProcessKeyEvent(keyEvent))
+		// タップ・ホールド等の時間で確定する処理を予約する
+		remapper.Processor.ScheduleExpire(source.Post, handleReports)
+	})
+	if err != nil {
+		logrus.Error(err)
+		os.Exit(1)
 	}
+	// 入力が終了した
+	output.WriteReports(sink, remapper.Processor.Reset())
+	output.WriteReports(sink, remapper.Keyboard.ZeroReports())
+	sink.Close()
 }
@@ -0,0 +1,304 @@
+// -*- coding:utf-8; -*-
+
+package output
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+const (
+	default_configfs_root = "/sys/kernel/config/usb_gadget"
+	default_udc_root      = "/sys/class/udc"
+)
+
+// USB gadget の設定
+type GadgetSetting struct {
+	// configfs の usb_gadget ディレクトリ。デフォルトは /sys/kernel/config/usb_gadget
+	ConfigFsRoot string
+	// UDC の一覧ディレクトリ。デフォルトは /sys/class/udc
+	UdcRoot string
+	// gadget 名。デフォルトは g1
+	Name string
+	// bind する UDC 名。空の場合は UdcRoot で最初に見つかった UDC
+	Udc string
+
+	// デフォルトは 0x1d6b (Linux Foundation)
+	IdVendor *hid.HexUint16
+	// デフォルトは 0x0104 (Multifunction Composite Gadget)
+	IdProduct *hid.HexUint16
+	// デフォルトは 0x0100 (v1.0.0)
+	BcdDevice *hid.HexUint16
+	// デフォルトは 0x0200 (USB2)
+	BcdUSB *hid.HexUint16
+
+	SerialNumber  string
+	Manufacturer  string
+	Product       string
+	Configuration string
+	// デフォルトは 250 mA
+	MaxPower int
+
+	// RNDIS (USB ネットワーク) を有効にするかどうか
+	Rndis bool
+	// Consumer/System Control 用の /dev/hidg1 を作成するかどうか。 nil の場合は作成する。
+	ExtHID *bool
+}
+
+// configfs の USB gadget を構築・削除する
+type Gadget struct {
+	setting    GadgetSetting
+	reportMode hid.ReportMode
+}
+
+func NewGadget(setting *GadgetSetting, reportMode hid.ReportMode) *Gadget {
+	gadget := &Gadget{*setting, reportMode}
+	if gadget.setting.ConfigFsRoot == "" {
+		gadget.setting.ConfigFsRoot = default_configfs_root
+	}
+	if gadget.setting.UdcRoot == "" {
+		gadget.setting.UdcRoot = default_udc_root
+	}
+	if gadget.setting.Name == "" {
+		gadget.setting.Name = "g1"
+	}
+	if gadget.setting.SerialNumber == "" {
+		gadget.setting.SerialNumber = "HID1234567890"
+	}
+	if gadget.setting.Manufacturer == "" {
+		gadget.setting.Manufacturer = "Linux"
+	}
+	if gadget.setting.Product == "" {
+		gadget.setting.Product = "Linux USB Gadget/HID"
+	}
+	if gadget.setting.Configuration == "" {
+		gadget.setting.Configuration = "Config 1: HID"
+	}
+	if gadget.setting.MaxPower == 0 {
+		gadget.setting.MaxPower = 250
+	}
+	return gadget
+}
+
+// gadget のディレクトリ
+func (gadget *Gadget) Dir() string {
+	return filepath.Join(gadget.setting.ConfigFsRoot, gadget.setting.Name)
+}
+
+func hexOr(val *hid.HexUint16, defaultVal uint16) string {
+	if val != nil {
+		return fmt.Sprintf("0x%04x", uint16(*val))
+	}
+	return fmt.Sprintf("0x%04x", defaultVal)
+}
+
+// gadget を構築して UDC に bind する。
+//
+// 既に同名の gadget がある場合は、一旦削除してから構築する。
+func (gadget *Gadget) Setup() error {
+	if _, err := os.Stat(gadget.setting.ConfigFsRoot); err != nil {
+		if gadget.setting.ConfigFsRoot != default_configfs_root {
+			return err
+		}
+		// configfs の usb_gadget は libcomposite を読み込むと作成される
+		if out, err := exec.Command("modprobe", "libcomposite").CombinedOutput(); err != nil {
+			return fmt.Errorf("modprobe libcomposite: %v: %s", err, out)
+		}
+	}
+	if _, err := os.Lstat(gadget.Dir()); err == nil {
+		if err := gadget.Teardown(); err != nil {
+			return err
+		}
+	}
+
+	writer := &attrWriter{dir: gadget.Dir()}
+	writer.mkdir("")
+	writer.write("idVendor", hexOr(gadget.setting.IdVendor, 0x1d6b))
+	writer.write("idProduct", hexOr(gadget.setting.IdProduct, 0x0104))
+	writer.write("bcdDevice", hexOr(gadget.setting.BcdDevice, 0x0100))
+	writer.write("bcdUSB", hexOr(gadget.setting.BcdUSB, 0x0200))
+	if gadget.setting.Rndis {
+		// RNDIS と HID の複合デバイス (IAD)
+		writer.write("bDeviceClass", "0xEF")
+		writer.write("bDeviceSubClass", "0x02")
+		writer.write("bDeviceProtocol", "0x01")
+	}
+	writer.mkdir("strings/0x409")
+	writer.write("strings/0x409/serialnumber", gadget.setting.SerialNumber)
+	writer.write("strings/0x409/manufacturer", gadget.setting.Manufacturer)
+	writer.write("strings/0x409/product", gadget.setting.Product)
+
+	config := "configs/c.1"
+	writer.mkdir(config + "/strings/0x409")
+	writer.write(config+"/MaxPower", fmt.Sprint(gadget.setting.MaxPower))
+	writer.write(config+"/strings/0x409/configuration", gadget.setting.Configuration)
+
+	if gadget.setting.Rndis {
+		// Windows は RNDIS が最初の function である必要がある
+		writer.mkdir("functions/rndis.usb0")
+		writer.link("functions/rndis.usb0", config)
+	}
+
+	// /dev/hidg0: キーボード
+	writer.mkdir("functions/hid.usb0")
+	writer.write("functions/hid.usb0/protocol", "1")
+	writer.write("functions/hid.usb0/subclass", "1")
+	writer.write("functions/hid.usb0/report_length",
+		fmt.Sprint(hid.KeyboardReportLength(gadget.reportMode)))
+	writer.writeBytes("functions/hid.usb0/report_desc",
+		hid.KeyboardReportDescriptor(gadget.reportMode))
+	writer.link("functions/hid.usb0", config)
+
+	if gadget.setting.ExtHID == nil || *gadget.setting.ExtHID {
+		// /dev/hidg1: Consumer Control, System Control
+		writer.mkdir("functions/hid.usb1")
+		writer.write("functions/hid.usb1/protocol", "0")
+		writer.write("functions/hid.usb1/subclass", "0")
+		writer.write("functions/hid.usb1/report_length", fmt.Sprint(hid.EXT_REPORT_LENGTH))
+		writer.writeBytes("functions/hid.usb1/report_desc", hid.ExtReportDescriptor())
+		writer.link("functions/hid.usb1", config)
+	}
+	if writer.err != nil {
+		return writer.err
+	}
+
+	udc, err := gadget.findUdc()
+	if err != nil {
+		return err
+	}
+	writer.write("UDC", udc)
+	if writer.err == nil {
+		log.Infof("gadget %s is bound to %s", gadget.Dir(), udc)
+	}
+	return writer.err
+}
+
+// bind する UDC 名を返す
+func (gadget *Gadget) findUdc() (string, error) {
+	if gadget.setting.Udc != "" {
+		return gadget.setting.Udc, nil
+	}
+	entries, err := ioutil.ReadDir(gadget.setting.UdcRoot)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("no UDC found in %s", gadget.setting.UdcRoot)
+	}
+	return entries[0].Name(), nil
+}
+
+// UDC から unbind し、 gadget を削除する。
+func (gadget *Gadget) Teardown() error {
+	dir := gadget.Dir()
+	if _, err := os.Lstat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	udcPath := filepath.Join(dir, "UDC")
+	if data, err := ioutil.ReadFile(udcPath); err == nil &&
+		strings.TrimSpace(string(data)) != "" {
+		if err := ioutil.WriteFile(udcPath, []byte("\n"), 0644); err != nil {
+			return fmt.Errorf("unbind %s: %v", udcPath, err)
+		}
+	}
+	if err := removeConfigFsTree(dir); err != nil {
+		return err
+	}
+	log.Infof("gadget %s is removed", dir)
+	return nil
+}
+
+// configfs が自動作成するディレクトリ名。これらは rmdir できず、親を削除すると消える。
+var configFsDefaultGroups = map[string]bool{
+	"functions": true,
+	"configs":   true,
+	"strings":   true,
+	"os_desc":   true,
+	"webusb":    true,
+	// rndis function の os_desc 内
+	"interface.rndis": true,
+}
+
+// configfs のディレクトリを削除する。
+//
+// configfs では属性ファイルは削除できず、ディレクトリを rmdir すると消える。
+// また configs 内の function へのリンクを、 function より先に削除する必要がある。
+// 名前順に深さ優先で削除すると configs → functions → strings の順になる。
+// テスト用の通常のディレクトリでも同じように削除できるよう、
+// ファイルの削除エラーと、 configfs が自動作成したディレクトリの削除エラーは無視する。
+// それ以外のディレクトリ (使用中の function 等) の削除エラーは返す。
+func removeConfigFsTree(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case entry.Mode()&os.ModeSymlink != 0:
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		case entry.IsDir():
+			if err := removeConfigFsTree(path); err != nil {
+				return err
+			}
+		default:
+			os.Remove(path)
+		}
+	}
+	if err := os.Remove(dir); err != nil && !configFsDefaultGroups[filepath.Base(dir)] {
+		return err
+	}
+	return nil
+}
+
+// configfs への書き込み。最初のエラーを保持し、以降の処理は行なわない。
+type attrWriter struct {
+	dir string
+	err error
+}
+
+func (writer *attrWriter) mkdir(path string) {
+	if writer.err != nil {
+		return
+	}
+	writer.err = os.MkdirAll(filepath.Join(writer.dir, path), 0755)
+}
+
+func (writer *attrWriter) write(path string, value string) {
+	writer.writeBytes(path, []byte(value+"\n"))
+}
+
+func (writer *attrWriter) writeBytes(path string, value []byte) {
+	if writer.err != nil {
+		return
+	}
+	fullPath := filepath.Join(writer.dir, path)
+	if err := ioutil.WriteFile(fullPath, value, 0644); err != nil {
+		writer.err = fmt.Errorf("write %s: %v", fullPath, err)
+	}
+}
+
+// function を config にリンクする
+func (writer *attrWriter) link(function string, config string) {
+	if writer.err != nil {
+		return
+	}
+	target := filepath.Join(writer.dir, function)
+	linkPath := filepath.Join(writer.dir, config, filepath.Base(function))
+	writer.err = os.Symlink(target, linkPath)
+}
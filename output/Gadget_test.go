@@ -0,0 +1,159 @@
+// -*- coding:utf-8; -*-
+
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// configfs と UDC の代わりの一時ディレクトリで GadgetSetting を作る
+func newTestGadgetSetting(t *testing.T) *GadgetSetting {
+	root := t.TempDir()
+	setting := &GadgetSetting{
+		ConfigFsRoot: filepath.Join(root, "usb_gadget"),
+		UdcRoot:      filepath.Join(root, "udc"),
+	}
+	if err := os.Mkdir(setting.ConfigFsRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(setting.UdcRoot, "fe980000.usb"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return setting
+}
+
+func readAttr(t *testing.T, gadget *Gadget, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(gadget.Dir(), path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGadgetSetupTeardown(t *testing.T) {
+	setting := newTestGadgetSetting(t)
+	setting.Rndis = true
+	gadget := NewGadget(setting, hid.ReportMode_NKRO)
+	if err := gadget.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := map[string]string{
+		"idVendor":                   "0x1d6b\n",
+		"idProduct":                  "0x0104\n",
+		"bcdUSB":                     "0x0200\n",
+		"bDeviceClass":               "0xEF\n",
+		"strings/0x409/serialnumber": "HID1234567890\n",
+		"configs/c.1/MaxPower":       "250\n",
+		"configs/c.1/strings/0x409/configuration": "Config 1: HID\n",
+		"functions/hid.usb0/protocol":             "1\n",
+		"functions/hid.usb0/subclass":             "1\n",
+		"functions/hid.usb0/report_length":        fmt.Sprintf("%d\n", hid.NKRO_REPORT_SIZE),
+		"functions/hid.usb1/protocol":             "0\n",
+		"functions/hid.usb1/report_length":        fmt.Sprintf("%d\n", hid.EXT_REPORT_LENGTH),
+		"UDC":                                     "fe980000.usb\n",
+	}
+	for path, expected := range attrs {
+		if value := readAttr(t, gadget, path); value != expected {
+			t.Errorf("%s: %q, expected %q", path, value, expected)
+		}
+	}
+	descs := map[string][]byte{
+		"functions/hid.usb0/report_desc": hid.KeyboardReportDescriptor(hid.ReportMode_NKRO),
+		"functions/hid.usb1/report_desc": hid.ExtReportDescriptor(),
+	}
+	for path, expected := range descs {
+		if value := readAttr(t, gadget, path); !bytes.Equal([]byte(value), expected) {
+			t.Errorf("%s: % x, expected % x", path, value, expected)
+		}
+	}
+
+	for _, function := range []string{"rndis.usb0", "hid.usb0", "hid.usb1"} {
+		linkPath := filepath.Join(gadget.Dir(), "configs/c.1", function)
+		target, err := os.Readlink(linkPath)
+		if err != nil {
+			t.Errorf("%s: %v", function, err)
+			continue
+		}
+		if expected := filepath.Join(gadget.Dir(), "functions", function); target != expected {
+			t.Errorf("%s: link to %s, expected %s", function, target, expected)
+		}
+	}
+
+	if err := gadget.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(setting.ConfigFsRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%s is left after Teardown", entry.Name())
+	}
+	// 削除済みの gadget の Teardown はエラーにしない
+	if err := gadget.Teardown(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGadgetSetupReplaces(t *testing.T) {
+	setting := newTestGadgetSetting(t)
+	if err := NewGadget(setting, hid.ReportMode_NKRO).Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 既存の gadget を削除してから、新しい設定で構築する
+	extHID := false
+	setting.ExtHID = &extHID
+	setting.Udc = "dummy.udc"
+	gadget := NewGadget(setting, hid.ReportMode_Boot)
+	if err := gadget.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if value := readAttr(t, gadget, "functions/hid.usb0/report_length"); value != "8\n" {
+		t.Errorf("report_length: %q", value)
+	}
+	if value := readAttr(t, gadget, "UDC"); value != "dummy.udc\n" {
+		t.Errorf("UDC: %q", value)
+	}
+	for _, path := range []string{"functions/hid.usb1", "configs/c.1/hid.usb1", "bDeviceClass"} {
+		if _, err := os.Lstat(filepath.Join(gadget.Dir(), path)); !os.IsNotExist(err) {
+			t.Errorf("%s is left from the previous gadget", path)
+		}
+	}
+}
+
+func TestGadgetTeardownReportsBusyFunction(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can remove files in a read-only directory")
+	}
+	setting := newTestGadgetSetting(t)
+	gadget := NewGadget(setting, hid.ReportMode_Boot)
+	if err := gadget.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	// 使用中で削除できない function の代わりに、中身を削除できないディレクトリを作る
+	busy := filepath.Join(gadget.Dir(), "functions/hid.usb0/busy")
+	if err := os.Mkdir(busy, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(busy, "attr"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(busy, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(busy, 0755)
+
+	if err := gadget.Teardown(); err == nil {
+		t.Error("Teardown must fail when a function can't be removed")
+	}
+}
@@ -0,0 +1,65 @@
+// -*- coding:utf-8; -*-
+
+package output
+
+import (
+	"io"
+	"os"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// USB gadget の HID デバイスへの出力
+type HIDGadgetOutput struct {
+	// キーボード (/dev/hidg0)
+	keyboard *os.File
+	// Consumer Control, System Control の拡張デバイス (/dev/hidg1)。
+	// 存在しない場合は nil。
+	ext *os.File
+}
+
+// keyboardPath と extPath の HID デバイスを開く。
+//
+// extPath が開けない場合は、拡張デバイスのレポートを破棄する。
+func OpenHIDGadgetOutput(keyboardPath, extPath string) (*HIDGadgetOutput, error) {
+	keyboard, err := os.OpenFile(keyboardPath, os.O_RDWR, os.ModeCharDevice)
+	if err != nil {
+		return nil, err
+	}
+	output := &HIDGadgetOutput{keyboard: keyboard}
+	if extPath != "" {
+		if ext, err := os.OpenFile(extPath, os.O_RDWR, os.ModeCharDevice); err != nil {
+			log.Warnf("%s is not available. ignore consumer and system keys: %v", extPath, err)
+		} else {
+			output.ext = ext
+		}
+	}
+	return output, nil
+}
+
+// LED output report はキーボードの HID デバイスから読み込む
+func (output *HIDGadgetOutput) Leds() io.Reader {
+	return output.keyboard
+}
+
+// report を送信する
+func (output *HIDGadgetOutput) Write(report hid.HIDReport) error {
+	switch report.Kind {
+	case hid.ReportKind_Keyboard:
+		_, err := output.keyboard.Write(report.Data)
+		return err
+	default:
+		if output.ext == nil {
+			return nil
+		}
+		_, err := output.ext.Write(report.Data)
+		return err
+	}
+}
+
+func (output *HIDGadgetOutput) Close() error {
+	if output.ext != nil {
+		output.ext.Close()
+	}
+	return output.keyboard.Close()
+}
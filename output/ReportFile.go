@@ -0,0 +1,68 @@
+// -*- coding:utf-8; -*-
+
+package output
+
+import (
+	"io"
+	"time"
+
+	"github.com/ifritJP/hw-keyboard-remapper/eventlog"
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// HID レポートをイベントログ (JSON Lines) の形式で書き込む出力先
+type ReportFileOutput struct {
+	writer *eventlog.Writer
+}
+
+// path のファイルを作成する。 path が "-" の場合は標準出力に書き込む。
+func OpenReportFileOutput(path string) (*ReportFileOutput, error) {
+	writer, err := eventlog.OpenWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ReportFileOutput{writer}, nil
+}
+
+func (output *ReportFileOutput) Leds() io.Reader {
+	return nil
+}
+
+// report を書き込む
+func (output *ReportFileOutput) Write(report hid.HIDReport) error {
+	return output.writer.Write(eventlog.NewReportRecord(report, time.Now()))
+}
+
+func (output *ReportFileOutput) Close() error {
+	return output.writer.Close()
+}
+
+// sink に出力する HID レポートを、イベントログにも書き込む出力先
+type RecordingOutput struct {
+	sink   ReportSink
+	writer *eventlog.Writer
+}
+
+// sink への出力を writer に記録する。 Close すると writer も閉じる。
+func NewRecordingOutput(sink ReportSink, writer *eventlog.Writer) *RecordingOutput {
+	return &RecordingOutput{sink, writer}
+}
+
+func (output *RecordingOutput) Leds() io.Reader {
+	return output.sink.Leds()
+}
+
+func (output *RecordingOutput) Write(report hid.HIDReport) error {
+	if err := output.writer.Write(eventlog.NewReportRecord(report, time.Now())); err != nil {
+		return err
+	}
+	return output.sink.Write(report)
+}
+
+func (output *RecordingOutput) Close() error {
+	err := output.sink.Close()
+	if closeErr := output.writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
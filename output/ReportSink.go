@@ -0,0 +1,100 @@
+// -*- coding:utf-8; -*-
+
+// Package output は、 USB gadget や uinput 等の HID レポートの出力先。
+package output
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ifritJP/hw-keyboard-remapper/engine"
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// ログの出力先
+var log engine.Logger = engine.NopLogger{}
+
+// output パッケージのログの出力先を設定する
+func SetLogger(logger engine.Logger) {
+	log = logger
+}
+
+// HID レポートの出力先
+type ReportSink interface {
+	// report を出力する
+	Write(report hid.HIDReport) error
+	// ホストからの LED output report を読み込む Reader。無い場合は nil。
+	//
+	// 1 回の Read で、先頭の 1 バイトが LedState のレポートを 1 つ返すこと。
+	Leds() io.Reader
+	Close() error
+}
+
+// 出力先のデフォルトの指定
+const DEFAULT_REPORT_SINK = "hidg"
+
+// spec の出力先を開く。
+//
+//	hidg                     USB gadget の /dev/hidg0, /dev/hidg1
+//	hidg:<keyboard>[,<ext>]  USB gadget の HID デバイスのパスを指定する
+//	uinput                   uinput の仮想キーボード。同じマシンでリマップする。
+//	file:<path>              レポートを JSON Lines で書き込む。 path が "-" の場合は標準出力。
+//	none                     レポートを破棄する
+func OpenReportSink(spec string) (ReportSink, error) {
+	if spec == "" {
+		spec = DEFAULT_REPORT_SINK
+	}
+	kind := spec
+	arg := ""
+	if index := strings.Index(spec, ":"); index >= 0 {
+		kind = spec[:index]
+		arg = spec[index+1:]
+	}
+	switch kind {
+	case "hidg":
+		keyboardPath, extPath := "/dev/hidg0", "/dev/hidg1"
+		if arg != "" {
+			paths := strings.SplitN(arg, ",", 2)
+			keyboardPath, extPath = paths[0], ""
+			if len(paths) > 1 {
+				extPath = paths[1]
+			}
+		}
+		return OpenHIDGadgetOutput(keyboardPath, extPath)
+	case "uinput":
+		return OpenUinputOutput()
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("output file isn't set -- %s", spec)
+		}
+		return OpenReportFileOutput(arg)
+	case "none":
+		return discardOutput{}, nil
+	}
+	return nil, fmt.Errorf("unknown output -- %s", spec)
+}
+
+// reports を順に出力する
+func WriteReports(sink ReportSink, reports []hid.HIDReport) {
+	for _, report := range reports {
+		if err := sink.Write(report); err != nil {
+			log.Errorf("write %v report: %v", report.Kind, err)
+		}
+	}
+}
+
+// レポートを破棄する出力先
+type discardOutput struct{}
+
+func (discardOutput) Write(report hid.HIDReport) error {
+	return nil
+}
+
+func (discardOutput) Leds() io.Reader {
+	return nil
+}
+
+func (discardOutput) Close() error {
+	return nil
+}
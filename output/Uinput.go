@@ -0,0 +1,245 @@
+// +build linux,!logger
+
+package output
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	evdev "github.com/gvalkov/golang-evdev"
+
+	"github.com/ifritJP/hw-keyboard-remapper/hid"
+)
+
+// linux/uinput.h の ioctl
+const (
+	ui_DEV_CREATE  = 0x5501
+	ui_DEV_DESTROY = 0x5502
+	ui_SET_EVBIT   = 0x40045564
+	ui_SET_KEYBIT  = 0x40045565
+	ui_SET_LEDBIT  = 0x40045569
+	bus_VIRTUAL    = 0x06
+)
+
+// linux/uinput.h の struct uinput_user_dev
+type uinputUserDev struct {
+	Name         [80]byte
+	Bustype      uint16
+	Vendor       uint16
+	Product      uint16
+	Version      uint16
+	FfEffectsMax uint32
+	Absmax       [64]int32
+	Absmin       [64]int32
+	Absfuzz      [64]int32
+	Absflat      [64]int32
+}
+
+// uinput の仮想キーボードへの出力。
+//
+// HID レポートの差分を linux のキーイベントに変換する。
+// ホストの LED の状態は、仮想キーボードへの EV_LED のイベントから得る。
+type UinputOutput struct {
+	file *os.File
+	// HID キーコード → linux のキーコード
+	hid2linux map[uint8]uint16
+	// Consumer Page の usage → linux のキーコード
+	consumer2linux map[uint16]uint16
+	// System Control の usage → linux のキーコード
+	system2linux map[uint16]uint16
+	// 押されている HID キーコード
+	pressed map[uint8]bool
+	// 押されている Consumer Page, System Control の usage
+	consumer uint16
+	system   uint16
+}
+
+// uinput の仮想キーボードを作成する
+func OpenUinputOutput() (*UinputOutput, error) {
+	file, err := os.OpenFile("/dev/uinput", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	output := &UinputOutput{
+		file:           file,
+		hid2linux:      map[uint8]uint16{},
+		consumer2linux: map[uint16]uint16{},
+		system2linux:   map[uint16]uint16{},
+		pressed:        map[uint8]bool{},
+	}
+	// 同じ HID キーコードになる linux のキーコードが複数ある場合は、小さい方を使う
+	table := hid.NewLinuxKeyTable()
+	for code := 0xff; code > 0; code-- {
+		linuxCode := uint8(code)
+		if hidCode, has := table.HIDCode[linuxCode]; has {
+			output.hid2linux[hidCode] = uint16(linuxCode)
+		}
+		if usage, has := table.Consumer[linuxCode]; has {
+			output.consumer2linux[usage] = uint16(linuxCode)
+		}
+		if usage, has := table.System[linuxCode]; has {
+			output.system2linux[uint16(usage)] = uint16(linuxCode)
+		}
+	}
+	if err := output.create(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return output, nil
+}
+
+func (output *UinputOutput) ioctl(request, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, output.file.Fd(), request, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (output *UinputOutput) create() error {
+	for _, evType := range []uintptr{evdev.EV_KEY, evdev.EV_LED, evdev.EV_REP, evdev.EV_SYN} {
+		if err := output.ioctl(ui_SET_EVBIT, evType); err != nil {
+			return err
+		}
+	}
+	linuxCodes := []uint16{}
+	for _, linuxCode := range output.hid2linux {
+		linuxCodes = append(linuxCodes, linuxCode)
+	}
+	for _, linuxCode := range output.consumer2linux {
+		linuxCodes = append(linuxCodes, linuxCode)
+	}
+	for _, linuxCode := range output.system2linux {
+		linuxCodes = append(linuxCodes, linuxCode)
+	}
+	for _, linuxCode := range linuxCodes {
+		if err := output.ioctl(ui_SET_KEYBIT, uintptr(linuxCode)); err != nil {
+			return err
+		}
+	}
+	for _, led := range hid.LinuxLeds {
+		if err := output.ioctl(ui_SET_LEDBIT, uintptr(led.Code)); err != nil {
+			return err
+		}
+	}
+	dev := uinputUserDev{Bustype: bus_VIRTUAL, Version: 1}
+	copy(dev.Name[:], hid.UINPUT_DEVICE_NAME)
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, &dev)
+	if _, err := output.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return output.ioctl(ui_DEV_CREATE, 0)
+}
+
+// report の前回からの差分を、キーイベントとして書き込む
+func (output *UinputOutput) Write(report hid.HIDReport) error {
+	events := []evdev.InputEvent{}
+	key := func(linuxCode uint16, has bool, pressed bool) {
+		if !has {
+			return
+		}
+		value := int32(0)
+		if pressed {
+			value = 1
+		}
+		events = append(events, evdev.InputEvent{
+			Type: evdev.EV_KEY, Code: linuxCode, Value: value})
+	}
+	switch report.Kind {
+	case hid.ReportKind_Keyboard:
+		codes, ok := report.KeyCodes()
+		if !ok {
+			// ErrorRollOver の間は、押されている状態を維持する
+			return nil
+		}
+		next := map[uint8]bool{}
+		for _, code := range codes {
+			next[code] = true
+		}
+		for code := range output.pressed {
+			if !next[code] {
+				linuxCode, has := output.hid2linux[code]
+				key(linuxCode, has, false)
+			}
+		}
+		for _, code := range codes {
+			if !output.pressed[code] {
+				linuxCode, has := output.hid2linux[code]
+				key(linuxCode, has, true)
+			}
+		}
+		output.pressed = next
+	case hid.ReportKind_Consumer, hid.ReportKind_System:
+		usageMap, current := output.consumer2linux, &output.consumer
+		if report.Kind == hid.ReportKind_System {
+			usageMap, current = output.system2linux, &output.system
+		}
+		usage := report.Usage()
+		if usage == *current {
+			return nil
+		}
+		if *current != 0 {
+			linuxCode, has := usageMap[*current]
+			key(linuxCode, has, false)
+		}
+		if usage != 0 {
+			linuxCode, has := usageMap[usage]
+			key(linuxCode, has, true)
+		}
+		*current = usage
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	events = append(events, evdev.InputEvent{Type: evdev.EV_SYN, Code: evdev.SYN_REPORT})
+	return binary.Write(output.file, binary.LittleEndian, events)
+}
+
+// ホストが仮想キーボードに設定した LED の状態を読み込む
+func (output *UinputOutput) Leds() io.Reader {
+	return &uinputLedReader{file: output.file}
+}
+
+func (output *UinputOutput) Close() error {
+	output.ioctl(ui_DEV_DESTROY, 0)
+	return output.file.Close()
+}
+
+// uinput の EV_LED のイベントを、 LedState の 1 バイトのレポートに変換する Reader
+type uinputLedReader struct {
+	file  *os.File
+	state hid.LedState
+}
+
+func (reader *uinputLedReader) Read(buf []byte) (int, error) {
+	eventBuf := make([]byte, unsafe.Sizeof(evdev.InputEvent{}))
+	for {
+		if _, err := io.ReadFull(reader.file, eventBuf); err != nil {
+			return 0, err
+		}
+		var event evdev.InputEvent
+		binary.Read(bytes.NewReader(eventBuf), binary.LittleEndian, &event)
+		if event.Type != evdev.EV_LED {
+			continue
+		}
+		for _, led := range hid.LinuxLeds {
+			if led.Code == event.Code {
+				if event.Value != 0 {
+					reader.state |= led.State
+				} else {
+					reader.state &^= led.State
+				}
+			}
+		}
+		if len(buf) == 0 {
+			return 0, nil
+		}
+		buf[0] = byte(reader.state)
+		return 1, nil
+	}
+}
@@ -0,0 +1,157 @@
+// -*- coding:utf-8; -*-
+
+// Package report は、押されているキーから HID レポートを作成する。
+package report
+
+import "github.com/ifritJP/hw-keyboard-remapper/hid"
+
+// 押されているキーと usage から、ホストに送信する HID レポートを作成する。
+//
+// レポート形式に従って、キーボードのレポートを作成する。
+type Builder struct {
+	// キーボードのレポート形式
+	reportMode hid.ReportMode
+	// HID のキーパケット
+	//
+	// ReportMode_Boot の場合 8 バイト
+	// byte0: modifier
+	// byte1: reservede
+	// byte2: pressed-key1
+	// byte3: pressed-key2
+	// byte4: pressed-key3
+	// byte5: pressed-key4
+	// byte6: pressed-key5
+	// byte7: pressed-key6
+	//
+	// ReportMode_NKRO の場合 NKRO_REPORT_SIZE バイト
+	// usage N の bit: byte[N/8] の bit (N%8)
+	// modifier は usage 0xE0-0xE7 の bit なので、最終バイトが modifier になる。
+	data []byte
+	// Consumer Control のパケット 3 バイト
+	// byte0: report ID
+	// byte1-2: usage (little endian)
+	consumerData []byte
+	// 最後に送信した Consumer Page の usage
+	lastConsumer uint16
+	// System Control のパケット 2 バイト
+	// byte0: report ID
+	// byte1: usage - 0x80 (0 は押されていない)
+	systemData []byte
+	// 最後に送信した System Control の usage
+	lastSystem byte
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		reportMode:   hid.ReportMode_Boot,
+		data:         make([]byte, 8),
+		consumerData: []byte{hid.REPORT_ID_Consumer, 0, 0},
+		systemData:   []byte{hid.REPORT_ID_System, 0},
+	}
+}
+
+// キーボードのレポート形式を設定する
+func (builder *Builder) SetReportMode(mode hid.ReportMode) {
+	builder.reportMode = mode
+	builder.data = make([]byte, builder.ReportSize())
+}
+
+// 設定されたキーボードのレポート形式を返す
+func (builder *Builder) GetReportMode() hid.ReportMode {
+	return builder.reportMode
+}
+
+// キーボードのレポートのバイト数
+func (builder *Builder) ReportSize() int {
+	if builder.reportMode == hid.ReportMode_NKRO {
+		return hid.NKRO_REPORT_SIZE
+	}
+	return 8
+}
+
+// HID のパケットを作成する。
+//
+// ReportMode_Boot の場合、キーは codes の順にパケットに格納する。
+// 6 キーを越えて押されている場合は、 HID の仕様に従って
+// 全キーを ErrorRollOver にしたパケットを返す。
+func (builder *Builder) KeyboardPacket(modifier byte, codes []byte) []byte {
+	// 一旦 data をクリアする
+	for index := range builder.data {
+		builder.data[index] = 0
+	}
+
+	if builder.reportMode == hid.ReportMode_NKRO {
+		for _, code := range codes {
+			if code <= hid.KEY_R_GUI {
+				builder.data[code/8] |= 1 << (code % 8)
+			}
+		}
+		// modifier は usage 0xE0-0xE7 の bit
+		builder.data[hid.KEY_L_Control/8] |= modifier
+		return builder.data
+	}
+
+	if len(codes) > len(builder.data)-2 {
+		for index := 2; index < len(builder.data); index++ {
+			builder.data[index] = hid.KEY_ErrorRollOver
+		}
+	} else {
+		copy(builder.data[2:], codes)
+	}
+	builder.data[0] = modifier
+	return builder.data
+}
+
+// Consumer Control のパケットを作成する。
+func (builder *Builder) ConsumerPacket(usage uint16) []byte {
+	builder.consumerData[1] = byte(usage)
+	builder.consumerData[2] = byte(usage >> 8)
+	return builder.consumerData
+}
+
+// System Control のパケットを作成する。
+func (builder *Builder) SystemPacket(usage byte) []byte {
+	if usage >= hid.SYSTEM_PowerDown && usage <= hid.SYSTEM_WakeUp {
+		builder.systemData[1] = usage - 0x80
+	} else {
+		builder.systemData[1] = 0
+	}
+	return builder.systemData
+}
+
+func cloneBytes(data []byte) []byte {
+	return append([]byte{}, data...)
+}
+
+// 全キーを離した状態のレポートを返す。
+//
+// 状態を変更しないので、強制終了時等に別の goroutine から呼び出して良い。
+func (builder *Builder) ZeroReports() []hid.HIDReport {
+	return []hid.HIDReport{
+		{Kind: hid.ReportKind_Keyboard, Data: make([]byte, builder.ReportSize())},
+		{Kind: hid.ReportKind_Consumer, Data: []byte{hid.REPORT_ID_Consumer, 0, 0}},
+		{Kind: hid.ReportKind_System, Data: []byte{hid.REPORT_ID_System, 0}},
+	}
+}
+
+// ホストに送信する HID レポートを作成する。
+//
+// キーボードのレポートは常に返す。
+// それ以外のレポートは、前回から変化があった場合だけ返す。
+// 複数のイベントのレポートをまとめて送信できるよう、レポートのデータは毎回コピーする。
+func (builder *Builder) Reports(
+	modifier byte, codes []byte, consumer uint16, system byte) []hid.HIDReport {
+	reports := []hid.HIDReport{
+		{Kind: hid.ReportKind_Keyboard, Data: cloneBytes(builder.KeyboardPacket(modifier, codes))}}
+	consumerData := cloneBytes(builder.ConsumerPacket(consumer))
+	if consumer != builder.lastConsumer {
+		builder.lastConsumer = consumer
+		reports = append(reports, hid.HIDReport{Kind: hid.ReportKind_Consumer, Data: consumerData})
+	}
+	systemData := cloneBytes(builder.SystemPacket(system))
+	if systemData[1] != builder.lastSystem {
+		builder.lastSystem = systemData[1]
+		reports = append(reports, hid.HIDReport{Kind: hid.ReportKind_System, Data: systemData})
+	}
+	return reports
+}
@@ -0,0 +1,38 @@
+// -*- coding:utf-8; -*-
+
+package report
+
+// 押されている usage を押された順に保持する
+type UsageState struct {
+	pressed []uint16
+}
+
+func (state *UsageState) Press(usage uint16) {
+	for _, pressed := range state.pressed {
+		if pressed == usage {
+			return
+		}
+	}
+	state.pressed = append(state.pressed, usage)
+}
+
+func (state *UsageState) Release(usage uint16) {
+	for index, pressed := range state.pressed {
+		if pressed == usage {
+			state.pressed = append(state.pressed[:index], state.pressed[index+1:]...)
+			return
+		}
+	}
+}
+
+func (state *UsageState) ReleaseAll() {
+	state.pressed = state.pressed[:0]
+}
+
+// 最後に押された usage を返す。押されていない場合は 0。
+func (state *UsageState) Last() uint16 {
+	if len(state.pressed) == 0 {
+		return 0
+	}
+	return state.pressed[len(state.pressed)-1]
+}